@@ -0,0 +1,20 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// newLogger builds the process-wide structured logger per Config.LogFormat:
+// "json" for one JSON object per line, or "text" (the default) for slog's
+// human-readable key=value format.
+func newLogger(format string) *slog.Logger {
+	var handler slog.Handler
+	switch format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, nil)
+	default:
+		handler = slog.NewTextHandler(os.Stdout, nil)
+	}
+	return slog.New(handler)
+}
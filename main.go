@@ -1,105 +1,454 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/http/httpproxy"
 	"gopkg.in/yaml.v3"
 )
 
-type PathMapping struct {
+// Route matches a request path against a regex and rewrites it to an
+// upstream target, optionally running request/response middleware along
+// the way. From/To keep the original path-mapping semantics (From is a
+// regexp, To is its replacement, both using regexp.ReplaceAllString
+// syntax, e.g. "$1"); everything else is new middleware.
+type Route struct {
 	From string `yaml:"from"`
 	To   string `yaml:"to"`
+
+	SetRequestHeaders    map[string]string `yaml:"set_request_headers"`
+	RemoveRequestHeaders []string          `yaml:"remove_request_headers"`
+	SetResponseHeaders   map[string]string `yaml:"set_response_headers"`
+
+	// BasicAuth names an entry in the top-level Config.Auth map; requests
+	// that don't satisfy it are rejected with 401 before being proxied.
+	BasicAuth string `yaml:"basic_auth"`
+
+	// FollowRedirects overrides Config.FollowRedirects for this route when
+	// set.
+	FollowRedirects *bool `yaml:"follow_redirects"`
+
+	// RewriteHost, when set, overrides the outgoing request's Host header
+	// (distinct from the URL host used to dial the target).
+	RewriteHost string `yaml:"rewrite_host"`
+
+	// ProxyURL overrides Config.ProxyURL (and the environment) for this
+	// route's outbound requests.
+	ProxyURL string `yaml:"proxy_url"`
+}
+
+// BasicAuthConfig is one named credential set in Config.Auth. PasswordHash
+// is a bcrypt hash, never a plaintext password.
+type BasicAuthConfig struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"`
 }
 
 type Config struct {
-	DefaultHost     string        `yaml:"default_host"`
-	PathMappings    []PathMapping `yaml:"path_mappings"`
-	FollowRedirects bool          `yaml:"follow_redirects"`
+	DefaultHost     string                     `yaml:"default_host"`
+	Routes          []Route                    `yaml:"routes"`
+	FollowRedirects bool                       `yaml:"follow_redirects"`
+	Auth            map[string]BasicAuthConfig `yaml:"auth"`
+	TLS             *TLSConfig                 `yaml:"tls"`
+
+	// ProxyURL is the outbound HTTP/HTTPS proxy used for upstream requests.
+	// When unset, HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables are
+	// honored instead. Routes can override this individually via
+	// Route.ProxyURL.
+	ProxyURL string `yaml:"proxy_url"`
+	// ProxyConnectHeader is sent on the CONNECT request to the outbound
+	// proxy above, e.g. to supply a Proxy-Authorization header.
+	ProxyConnectHeader map[string]string `yaml:"proxy_connect_header"`
+
+	// FlushInterval controls how often streamed response bodies are
+	// flushed to the client. Server-Sent Events (text/event-stream)
+	// responses, and responses without a Content-Length, are always
+	// flushed immediately regardless of this setting. Otherwise, zero (the
+	// default) flushes only when the buffer fills or the response ends.
+	FlushInterval duration `yaml:"flush_interval"`
+
+	// AdminAddr, when set, starts a second listener serving /metrics
+	// (Prometheus text format) and /__proxy/config (the current config
+	// generation and reload time). Left empty, no admin listener is
+	// started.
+	AdminAddr string `yaml:"admin_addr"`
+
+	// LogFormat selects the per-request log line's encoding: "json" for
+	// one JSON object per line, or "text" (the default) for slog's
+	// human-readable key=value format.
+	LogFormat string `yaml:"log_format"`
+}
+
+// duration wraps time.Duration so it can be set in YAML using Go's
+// duration syntax (e.g. "250ms") rather than a raw integer of nanoseconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", value.Value, err)
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// TLSConfig configures the optional HTTPS listener started alongside the
+// plain HTTP one. Set CertFile/KeyFile for a static certificate, or
+// AutoCert to have certificates issued and renewed automatically via ACME.
+type TLSConfig struct {
+	// Addr is the address the HTTPS listener binds to, e.g. ":8443".
+	// Defaults to ":8443" when unset.
+	Addr     string          `yaml:"addr"`
+	CertFile string          `yaml:"cert_file"`
+	KeyFile  string          `yaml:"key_file"`
+	AutoCert *AutoCertConfig `yaml:"autocert"`
+}
+
+// AutoCertConfig enables automatic certificate issuance and renewal via
+// Let's Encrypt (or another ACME CA) using golang.org/x/crypto/acme/autocert.
+type AutoCertConfig struct {
+	// CacheDir is where issued certificates are persisted between restarts.
+	CacheDir string `yaml:"cache_dir"`
+	// Hosts is the allowlist of hostnames autocert will issue certificates
+	// for; requests for any other hostname are refused.
+	Hosts []string `yaml:"hosts"`
+}
+
+// compiledRoute pairs a Route with its compiled regex and, when the route
+// overrides FollowRedirects, sets its own ProxyURL, or targets an upstream
+// via "https+insecure://", a dedicated client to use instead of the
+// proxy-wide default.
+type compiledRoute struct {
+	regex  *regexp.Regexp
+	route  Route
+	client *http.Client
 }
 
-type compiledMapping struct {
-	regex *regexp.Regexp
-	to    string
+// expandTargetURL expands the shorthand target specs accepted in
+// DefaultHost and Route.To, following Tailscale's expandProxyArg
+// convention: a bare port like "3030" expands to "http://127.0.0.1:3030",
+// and an "https+insecure://" scheme is accepted for upstreams presenting
+// certificates that can't (or shouldn't) be verified, e.g. self-signed
+// internal services.
+func expandTargetURL(raw string) (target string, insecureTLS bool) {
+	if _, err := strconv.Atoi(raw); err == nil {
+		return "http://127.0.0.1:" + raw, false
+	}
+	if rest, ok := strings.CutPrefix(raw, "https+insecure://"); ok {
+		return "https://" + rest, true
+	}
+	return raw, false
 }
 
 type Proxy struct {
-	client           *http.Client
-	defaultHost      string
-	compiledMappings []compiledMapping
-	followRedirects  bool
+	rp              *httputil.ReverseProxy
+	client          *http.Client
+	defaultHost     string
+	compiledRoutes  []compiledRoute
+	followRedirects bool
+	auth            map[string]BasicAuthConfig
+	metrics         *Metrics
 }
 
-func NewProxy(defaultHost string, mappings []PathMapping, followRedirects bool) (*Proxy, error) {
-	var compiled []compiledMapping
-	
-	for _, mapping := range mappings {
-		regex, err := regexp.Compile(mapping.From)
+func NewProxy(defaultHost string, routes []Route, followRedirects bool, auth map[string]BasicAuthConfig, proxyURL string, proxyConnectHeader map[string]string, flushInterval time.Duration) (*Proxy, error) {
+	var compiled []compiledRoute
+	connectHeader := toProxyConnectHeader(proxyConnectHeader)
+
+	for _, route := range routes {
+		expandedTo, insecureTLS := expandTargetURL(route.To)
+		route.To = expandedTo
+
+		regex, err := regexp.Compile(route.From)
 		if err != nil {
-			return nil, fmt.Errorf("invalid regex pattern '%s': %w", mapping.From, err)
+			return nil, fmt.Errorf("invalid regex pattern '%s': %w", route.From, err)
 		}
-		compiled = append(compiled, compiledMapping{
-			regex: regex,
-			to:    mapping.To,
-		})
+
+		cr := compiledRoute{regex: regex, route: route}
+		if route.FollowRedirects != nil || insecureTLS || route.ProxyURL != "" {
+			routeFollowRedirects := followRedirects
+			if route.FollowRedirects != nil {
+				routeFollowRedirects = *route.FollowRedirects
+			}
+			routeProxyURL := proxyURL
+			if route.ProxyURL != "" {
+				routeProxyURL = route.ProxyURL
+			}
+			proxyFunc, err := proxyFuncFor(routeProxyURL)
+			if err != nil {
+				return nil, err
+			}
+			cr.client = newHTTPClient(routeFollowRedirects, insecureTLS, proxyFunc, connectHeader)
+		}
+		compiled = append(compiled, cr)
 	}
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	for name, cred := range auth {
+		if cred.Username == "" || cred.PasswordHash == "" {
+			return nil, fmt.Errorf("auth set %q must have a username and password_hash", name)
+		}
+	}
+
+	expandedDefaultHost, defaultInsecureTLS := expandTargetURL(defaultHost)
+
+	defaultProxyFunc, err := proxyFuncFor(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		client:          newHTTPClient(followRedirects, defaultInsecureTLS, defaultProxyFunc, connectHeader),
+		defaultHost:     expandedDefaultHost,
+		compiledRoutes:  compiled,
+		followRedirects: followRedirects,
+		auth:            auth,
+		metrics:         newMetrics(),
+	}
+
+	p.rp = &httputil.ReverseProxy{
+		Director:       p.director,
+		Transport:      routeClientTransport{},
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, "Failed to reach target server", http.StatusBadGateway)
+			info := routingInfoFromContext(r.Context())
+			route := "unmatched"
+			if info != nil {
+				route = info.routeLabel
+			}
+			p.metrics.observeUpstreamError(route, classifyUpstreamError(err))
+			slog.Error("error sending request upstream", "route", route, "error", err)
+		},
+		FlushInterval: flushInterval,
+	}
+
+	return p, nil
+}
+
+// routingInfoKey is the context key ServeHTTP uses to pass the resolved
+// target URL, matched route, and client down to the Director and
+// Transport - both of which only see the in-flight *http.Request.
+type routingInfoKey struct{}
+
+// routingInfo is resolved once per request in ServeHTTP (where buildTargetURL
+// and basic auth can still reject it with a normal error response) and then
+// carried through the ReverseProxy's Director/Transport/ModifyResponse
+// callbacks via the request context.
+type routingInfo struct {
+	targetURL string
+	route     *Route
+	client    *http.Client
+	// routeLabel is the matched route's From pattern, "default" when the
+	// default host was used instead, used as the Prometheus "route" label
+	// and in the per-request log line.
+	routeLabel string
+}
+
+func routingInfoFromContext(ctx context.Context) *routingInfo {
+	info, _ := ctx.Value(routingInfoKey{}).(*routingInfo)
+	return info
+}
+
+// routeClientTransport adapts the *http.Client chosen for a request (which
+// may be the route-specific override client) to the http.RoundTripper
+// interface ReverseProxy.Transport expects, so that per-route settings like
+// follow_redirects and proxy_url still apply. Connection: Upgrade requests
+// (WebSockets) bypass the client and go straight to its Transport, because
+// httputil.ReverseProxy's upgrade handling needs the raw, hijackable
+// response body that http.Client.Do wraps and hides.
+type routeClientTransport struct{}
+
+func (routeClientTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	info := routingInfoFromContext(r.Context())
+	if isUpgradeRequest(r.Header) {
+		if transport, ok := info.client.Transport.(http.RoundTripper); ok {
+			return transport.RoundTrip(r)
+		}
+	}
+	return info.client.Do(r)
+}
+
+// isUpgradeRequest reports whether h asks to switch protocols, e.g. for a
+// WebSocket handshake (Connection: Upgrade, Upgrade: websocket).
+func isUpgradeRequest(h http.Header) bool {
+	return strings.Contains(strings.ToLower(h.Get("Connection")), "upgrade") && h.Get("Upgrade") != ""
+}
+
+// director rewrites the request Transport will send: it sets the resolved
+// target URL, applies the matched route's header/host middleware, and sets
+// the X-Forwarded-Proto/X-Forwarded-Host headers. X-Forwarded-For is left
+// to httputil.ReverseProxy, which already appends to (rather than
+// overwrites) any existing chain and strips the client's port.
+func (p *Proxy) director(r *http.Request) {
+	info := routingInfoFromContext(r.Context())
+
+	originalHost := r.Host
+	originalProto := "http"
+	if r.TLS != nil {
+		originalProto = "https"
+	}
+
+	target, err := url.Parse(info.targetURL)
+	if err != nil {
+		// buildTargetURL already validated this URL in ServeHTTP before the
+		// request reached the Director, so this should not happen.
+		slog.Error("director: failed to parse resolved target URL", "url", info.targetURL, "error", err)
+		return
+	}
+	r.URL = target
+	r.Host = target.Host
+	// RequestURI is populated for incoming server requests but must be
+	// cleared before the request is reused client-side, via client.Do, in
+	// routeClientTransport.
+	r.RequestURI = ""
+
+	if info.route != nil {
+		for _, name := range info.route.RemoveRequestHeaders {
+			r.Header.Del(name)
+		}
+		for name, value := range info.route.SetRequestHeaders {
+			r.Header.Set(name, value)
+		}
+		if info.route.RewriteHost != "" {
+			r.Host = info.route.RewriteHost
+		}
+	}
+
+	r.Header.Set("X-Forwarded-Proto", originalProto)
+	r.Header.Set("X-Forwarded-Host", originalHost)
+}
+
+// modifyResponse applies the matched route's response header middleware
+// before httputil.ReverseProxy writes the response to the client.
+func (p *Proxy) modifyResponse(res *http.Response) error {
+	info := routingInfoFromContext(res.Request.Context())
+	if info.route != nil {
+		for name, value := range info.route.SetResponseHeaders {
+			res.Header.Set(name, value)
+		}
+	}
+	return nil
+}
+
+// proxyFuncFor returns the outbound proxy selection function a client
+// should use. An explicit proxyURL always wins; otherwise the environment
+// (HTTP_PROXY/HTTPS_PROXY/NO_PROXY) is honored, matched via
+// golang.org/x/net/http/httpproxy so NO_PROXY entries support CIDR ranges
+// and domain suffixes.
+func proxyFuncFor(proxyURL string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURL == "" {
+		cfg := httpproxy.FromEnvironment()
+		return func(req *http.Request) (*url.URL, error) {
+			return cfg.ProxyFunc()(req.URL)
+		}, nil
+	}
+
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy_url %q: %w", proxyURL, err)
+	}
+	return http.ProxyURL(parsed), nil
+}
+
+// toProxyConnectHeader converts the yaml-friendly map[string]string form of
+// ProxyConnectHeader into an http.Header, or nil if empty.
+func toProxyConnectHeader(m map[string]string) http.Header {
+	if len(m) == 0 {
+		return nil
+	}
+	h := make(http.Header, len(m))
+	for k, v := range m {
+		h.Set(k, v)
+	}
+	return h
+}
+
+// newHTTPClient builds a client that either follows redirects normally or
+// returns the first redirect response as-is, per followRedirects. When
+// insecureTLS is set, the client skips upstream certificate verification -
+// only appropriate for upstreams reached via "https+insecure://". proxyFunc
+// selects the outbound proxy (if any) for each request, and
+// proxyConnectHeader is sent on the CONNECT to that proxy.
+func newHTTPClient(followRedirects bool, insecureTLS bool, proxyFunc func(*http.Request) (*url.URL, error), proxyConnectHeader http.Header) *http.Client {
+	transport := &http.Transport{
+		Proxy:              proxyFunc,
+		ProxyConnectHeader: proxyConnectHeader,
+	}
+	if insecureTLS {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
-	// Configure redirect behavior
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: transport,
+	}
 	if !followRedirects {
 		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		}
 	}
+	return client
+}
 
-	return &Proxy{
-		client:           client,
-		defaultHost:      defaultHost,
-		compiledMappings: compiled,
-		followRedirects:  followRedirects,
-	}, nil
+// clientFor returns the client a matched route should proxy through: its
+// own override if one was built (see compiledRoute), otherwise the proxy
+// default.
+func (p *Proxy) clientFor(cr *compiledRoute) *http.Client {
+	if cr != nil && cr.client != nil {
+		return cr.client
+	}
+	return p.client
 }
 
-func (p *Proxy) findMapping(path string) (string, bool) {
-	for _, mapping := range p.compiledMappings {
-		if mapping.regex.MatchString(path) {
-			result := mapping.regex.ReplaceAllString(path, mapping.to)
-			return result, true
+// findRoute returns the first route whose From regex matches path, along
+// with the rewritten target path/URL.
+func (p *Proxy) findRoute(path string) (*compiledRoute, string, bool) {
+	for i := range p.compiledRoutes {
+		cr := &p.compiledRoutes[i]
+		if cr.regex.MatchString(path) {
+			result := cr.regex.ReplaceAllString(path, cr.route.To)
+			return cr, result, true
 		}
 	}
-	return "", false
+	return nil, "", false
 }
 
-func (p *Proxy) buildTargetURL(r *http.Request) (string, error) {
+// buildTargetURL resolves the upstream URL for r: a matching route's
+// rewritten target, or the default host with the original path and query
+// preserved. It also returns the matched route, if any, so ServeHTTP can
+// run its middleware.
+func (p *Proxy) buildTargetURL(r *http.Request) (string, *compiledRoute, error) {
 	originalPath := r.URL.Path
 	if r.URL.RawQuery != "" {
 		originalPath += "?" + r.URL.RawQuery
 	}
 
-	// Check if path matches any mapping
-	if mappedURL, found := p.findMapping(originalPath); found {
-		log.Printf("Path matched mapping: %s -> %s", originalPath, mappedURL)
-		return mappedURL, nil
+	if cr, mappedURL, found := p.findRoute(originalPath); found {
+		slog.Debug("path matched route", "path", originalPath, "target", mappedURL)
+		return mappedURL, cr, nil
 	}
 
-	// Use default host replacement
 	if p.defaultHost == "" {
-		return "", fmt.Errorf("no default host configured and no mapping matched")
+		return "", nil, fmt.Errorf("no default host configured and no mapping matched")
 	}
 
 	parsed, err := url.Parse(p.defaultHost)
 	if err != nil {
-		return "", fmt.Errorf("invalid default host: %w", err)
+		return "", nil, fmt.Errorf("invalid default host: %w", err)
 	}
 
 	targetURL := &url.URL{
@@ -109,66 +458,85 @@ func (p *Proxy) buildTargetURL(r *http.Request) (string, error) {
 		RawQuery: r.URL.RawQuery,
 	}
 
-	return targetURL.String(), nil
+	return targetURL.String(), nil, nil
 }
 
-func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Proxying request: %s %s", r.Method, r.URL.String())
+// checkBasicAuth enforces authName's credentials against r, writing a 401
+// (or 500, if the route references an auth set that doesn't exist) and
+// returning false when the request should not proceed.
+func (p *Proxy) checkBasicAuth(w http.ResponseWriter, r *http.Request, authName string) bool {
+	cred, ok := p.auth[authName]
+	if !ok {
+		http.Error(w, "Server misconfigured", http.StatusInternalServerError)
+		slog.Error("route references unknown auth set", "auth", authName)
+		return false
+	}
 
-	targetURL, err := p.buildTargetURL(r)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to build target URL: %v", err), http.StatusBadGateway)
-		log.Printf("Error building target URL: %v", err)
-		return
+	username, password, ok := r.BasicAuth()
+	if ok {
+		ok = username == cred.Username && bcrypt.CompareHashAndPassword([]byte(cred.PasswordHash), []byte(password)) == nil
 	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="tcz-proxy"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	p.metrics.inFlight.Inc()
+	defer p.metrics.inFlight.Dec()
 
-	log.Printf("Target URL: %s", targetURL)
+	rec := &statusRecorder{ResponseWriter: w}
 
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
+	targetURL, cr, err := p.buildTargetURL(r)
 	if err != nil {
-		http.Error(w, "Failed to create proxy request", http.StatusInternalServerError)
-		log.Printf("Error creating request: %v", err)
+		http.Error(rec, fmt.Sprintf("Failed to build target URL: %v", err), http.StatusBadGateway)
+		slog.Error("failed to build target url", "error", err)
+		p.logRequest(rec, r, "unmatched", "", start)
 		return
 	}
 
-	// Copy headers from original request
-	for name, values := range r.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(name, value)
-		}
-	}
-
-	// Add X-Forwarded-For header
-	if clientIP := r.RemoteAddr; clientIP != "" {
-		proxyReq.Header.Set("X-Forwarded-For", clientIP)
+	var route *Route
+	routeLabel := "default"
+	if cr != nil {
+		route = &cr.route
+		routeLabel = route.From
 	}
 
-	// Send the request
-	resp, err := p.client.Do(proxyReq)
-	if err != nil {
-		http.Error(w, "Failed to reach target server", http.StatusBadGateway)
-		log.Printf("Error sending request: %v", err)
+	if route != nil && route.BasicAuth != "" && !p.checkBasicAuth(rec, r, route.BasicAuth) {
+		p.logRequest(rec, r, routeLabel, targetURL, start)
 		return
 	}
-	defer resp.Body.Close()
-
-	// Copy response headers
-	for name, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(name, value)
-		}
-	}
 
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
+	info := &routingInfo{targetURL: targetURL, route: route, client: p.clientFor(cr), routeLabel: routeLabel}
+	ctx := context.WithValue(r.Context(), routingInfoKey{}, info)
+	p.rp.ServeHTTP(rec, r.WithContext(ctx))
+	p.logRequest(rec, r, routeLabel, targetURL, start)
+}
 
-	// Copy response body
-	_, err = io.Copy(w, resp.Body)
-	if err != nil {
-		log.Printf("Error copying response body: %v", err)
+// logRequest emits the single structured log line for a completed request
+// (method, route, upstream URL, status, bytes, duration) and records the
+// same fields as Prometheus metrics.
+func (p *Proxy) logRequest(rec *statusRecorder, r *http.Request, route, upstream string, start time.Time) {
+	duration := time.Since(start)
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
 	}
 
-	log.Printf("Completed: %s %s - Status: %d", r.Method, targetURL, resp.StatusCode)
+	p.metrics.observeRequest(route, r.Method, strconv.Itoa(status), duration)
+
+	slog.Info("request",
+		"method", r.Method,
+		"route", route,
+		"upstream", upstream,
+		"status", status,
+		"bytes", rec.bytes,
+		"duration_ms", duration.Milliseconds(),
+	)
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -219,29 +587,49 @@ func main() {
 	// Load configuration
 	config, err := loadConfig(*configFile)
 	if err != nil {
-		log.Printf("Warning: Failed to load config file: %v", err)
+		slog.Warn("failed to load config file", "error", err)
 		config = &Config{}
 	}
 
+	slog.SetDefault(newLogger(config.LogFormat))
+
 	// Apply host override if provided
 	defaultHost := config.DefaultHost
 	if *hostOverride != "" {
 		defaultHost = *hostOverride
-		log.Printf("Using host override: %s", defaultHost)
+		slog.Info("using host override", "host", defaultHost)
 	}
 
 	// Determine follow redirects setting (command line takes precedence)
 	followRedirects := config.FollowRedirects
 	if *followRedirectsFlag {
 		followRedirects = true
-		log.Printf("Following redirects enabled via command line")
+		slog.Info("following redirects enabled via command line")
 	}
 
-	// Create proxy
-	proxy, err := NewProxy(defaultHost, config.PathMappings, followRedirects)
+	// Create the proxy, and a watcher that rebuilds it on SIGHUP or config
+	// file changes so operators can pick up route/auth changes without
+	// dropping in-flight connections. defaultHost/followRedirects above
+	// already fold in the CLI overrides, which also apply to every reload.
+	buildProxy := func(c *Config) (*Proxy, error) {
+		host := c.DefaultHost
+		if *hostOverride != "" {
+			host = *hostOverride
+		}
+		fr := c.FollowRedirects
+		if *followRedirectsFlag {
+			fr = true
+		}
+		return NewProxy(host, c.Routes, fr, c.Auth, c.ProxyURL, c.ProxyConnectHeader, time.Duration(c.FlushInterval))
+	}
+
+	configWatcher, err := NewConfigWatcher(*configFile, config, buildProxy)
 	if err != nil {
-		log.Fatalf("Failed to create proxy: %v", err)
+		slog.Error("failed to create proxy", "error", err)
+		os.Exit(1)
 	}
+	configWatcher.Start()
+	defer configWatcher.Stop()
 
 	// Display configuration
 	fmt.Printf("Starting tcz-proxy on port %s\n", listenPort)
@@ -249,18 +637,103 @@ func main() {
 		fmt.Printf("Default host: %s\n", defaultHost)
 	}
 	fmt.Printf("Follow redirects: %v\n", followRedirects)
-	if len(config.PathMappings) > 0 {
-		fmt.Printf("Path mappings (%d):\n", len(config.PathMappings))
-		for i, mapping := range config.PathMappings {
-			fmt.Printf("  %d. %s -> %s\n", i+1, mapping.From, mapping.To)
+	if config.ProxyURL != "" {
+		fmt.Printf("Outbound proxy: %s\n", config.ProxyURL)
+	}
+	if len(config.Routes) > 0 {
+		fmt.Printf("Routes (%d):\n", len(config.Routes))
+		for i, route := range config.Routes {
+			fmt.Printf("  %d. %s -> %s\n", i+1, route.From, route.To)
 		}
 	}
+	if config.TLS != nil {
+		fmt.Printf("HTTPS listener: %s\n", tlsListenAddr(config.TLS))
+	}
+	if config.AdminAddr != "" {
+		fmt.Printf("Admin listener: %s\n", config.AdminAddr)
+	}
 	fmt.Println()
 
+	if config.TLS != nil {
+		go func() {
+			if err := serveTLS(config.TLS, configWatcher); err != nil {
+				slog.Error("https listener failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if config.AdminAddr != "" {
+		go func() {
+			if err := serveAdmin(config.AdminAddr, configWatcher); err != nil {
+				slog.Error("admin listener failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	// Start server
 	addr := ":" + listenPort
-	log.Printf("Listening on %s", addr)
-	if err := http.ListenAndServe(addr, proxy); err != nil {
-		log.Fatal(err)
+	slog.Info("listening", "addr", addr)
+	if err := http.ListenAndServe(addr, configWatcher); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
 	}
 }
+
+// serveAdmin starts the admin listener exposing /metrics (Prometheus text
+// format for the currently loaded proxy) and /__proxy/config (the config
+// watcher's generation number and last reload time, so operators can
+// confirm a SIGHUP or file-change reload took effect). It blocks until the
+// listener returns an error.
+func serveAdmin(addr string, cw *ConfigWatcher) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		cw.Metrics().Handler().ServeHTTP(w, r)
+	})
+	mux.HandleFunc("/__proxy/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Generation uint64    `json:"generation"`
+			LastReload time.Time `json:"last_reload"`
+		}{cw.Generation(), cw.LastReload()})
+	})
+
+	slog.Info("listening", "addr", addr, "role", "admin")
+	return http.ListenAndServe(addr, mux)
+}
+
+// tlsListenAddr returns the address the HTTPS listener binds to, applying
+// the same default used by serveTLS.
+func tlsListenAddr(cfg *TLSConfig) string {
+	if cfg.Addr != "" {
+		return cfg.Addr
+	}
+	return ":8443"
+}
+
+// serveTLS starts the HTTPS listener described by cfg, using either a
+// static certificate (CertFile/KeyFile) or autocert for automatic ACME
+// certificates. It blocks until the listener returns an error.
+func serveTLS(cfg *TLSConfig, handler http.Handler) error {
+	addr := tlsListenAddr(cfg)
+
+	if cfg.AutoCert != nil {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AutoCert.Hosts...),
+			Cache:      autocert.DirCache(cfg.AutoCert.CacheDir),
+		}
+		server := &http.Server{
+			Addr:      addr,
+			Handler:   handler,
+			TLSConfig: manager.TLSConfig(),
+		}
+		slog.Info("listening", "addr", addr, "role", "https", "cert", "autocert")
+		return server.ListenAndServeTLS("", "")
+	}
+
+	slog.Info("listening", "addr", addr, "role", "https")
+	server := &http.Server{Addr: addr, Handler: handler}
+	return server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+}
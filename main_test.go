@@ -1,20 +1,27 @@
 package main
 
 import (
+	"encoding/base64"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/websocket"
 )
 
 func TestNewProxy(t *testing.T) {
-	mappings := []PathMapping{
+	routes := []Route{
 		{From: `/test/(\d+)`, To: `https://example.com/$1`},
 	}
 
-	proxy, err := NewProxy("https://default.com", mappings)
+	proxy, err := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
 	if err != nil {
 		t.Fatalf("NewProxy failed: %v", err)
 	}
@@ -31,17 +38,17 @@ func TestNewProxy(t *testing.T) {
 		t.Errorf("Expected default host 'https://default.com', got '%s'", proxy.defaultHost)
 	}
 
-	if len(proxy.compiledMappings) != 1 {
-		t.Errorf("Expected 1 compiled mapping, got %d", len(proxy.compiledMappings))
+	if len(proxy.compiledRoutes) != 1 {
+		t.Errorf("Expected 1 compiled route, got %d", len(proxy.compiledRoutes))
 	}
 }
 
 func TestNewProxy_InvalidRegex(t *testing.T) {
-	mappings := []PathMapping{
+	routes := []Route{
 		{From: `[invalid(regex`, To: `https://example.com`},
 	}
 
-	_, err := NewProxy("https://default.com", mappings)
+	_, err := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
 	if err == nil {
 		t.Error("Expected error for invalid regex, got nil")
 	}
@@ -51,13 +58,50 @@ func TestNewProxy_InvalidRegex(t *testing.T) {
 	}
 }
 
-func TestFindMapping(t *testing.T) {
-	mappings := []PathMapping{
+func TestNewProxy_InvalidAuth(t *testing.T) {
+	auth := map[string]BasicAuthConfig{
+		"admin": {Username: "admin"},
+	}
+
+	_, err := NewProxy("https://default.com", nil, false, auth, "", nil, 0)
+	if err == nil {
+		t.Error("Expected error for auth set missing a password hash, got nil")
+	}
+}
+
+func TestExpandTargetURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		raw          string
+		expected     string
+		wantInsecure bool
+	}{
+		{name: "bare port", raw: "3030", expected: "http://127.0.0.1:3030"},
+		{name: "https+insecure scheme", raw: "https+insecure://internal.local:8443", expected: "https://internal.local:8443", wantInsecure: true},
+		{name: "ordinary URL is unchanged", raw: "https://example.com", expected: "https://example.com"},
+		{name: "empty string is unchanged", raw: "", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, insecure := expandTargetURL(tt.raw)
+			if got != tt.expected {
+				t.Errorf("expandTargetURL(%q) = %q, want %q", tt.raw, got, tt.expected)
+			}
+			if insecure != tt.wantInsecure {
+				t.Errorf("expandTargetURL(%q) insecure = %v, want %v", tt.raw, insecure, tt.wantInsecure)
+			}
+		})
+	}
+}
+
+func TestFindRoute(t *testing.T) {
+	routes := []Route{
 		{From: `.*/(\d+)\.x/(aarch64|armhf)/tcz/watchdog\.tcz`, To: `https://github.com/releases/download/$1/watchdog-$2.zip`},
 		{From: `/api/v(\d+)/users`, To: `https://api.example.com/v$1/users`},
 	}
 
-	proxy, err := NewProxy("https://default.com", mappings)
+	proxy, err := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
 	if err != nil {
 		t.Fatalf("Failed to create proxy: %v", err)
 	}
@@ -96,7 +140,7 @@ func TestFindMapping(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result, found := proxy.findMapping(tt.path)
+			_, result, found := proxy.findRoute(tt.path)
 
 			if found != tt.found {
 				t.Errorf("Expected found=%v, got found=%v", tt.found, found)
@@ -110,14 +154,14 @@ func TestFindMapping(t *testing.T) {
 }
 
 func TestBuildTargetURL_WithMapping(t *testing.T) {
-	mappings := []PathMapping{
+	routes := []Route{
 		{From: `/test/(\d+)`, To: `https://mapped.com/item/$1`},
 	}
 
-	proxy, _ := NewProxy("https://default.com", mappings)
+	proxy, _ := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
 
 	req := httptest.NewRequest("GET", "http://localhost/test/123", nil)
-	targetURL, err := proxy.buildTargetURL(req)
+	targetURL, _, err := proxy.buildTargetURL(req)
 
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
@@ -130,10 +174,10 @@ func TestBuildTargetURL_WithMapping(t *testing.T) {
 }
 
 func TestBuildTargetURL_WithDefaultHost(t *testing.T) {
-	proxy, _ := NewProxy("https://default.com", nil)
+	proxy, _ := NewProxy("https://default.com", nil, false, nil, "", nil, 0)
 
 	req := httptest.NewRequest("GET", "http://localhost/some/path?key=value", nil)
-	targetURL, err := proxy.buildTargetURL(req)
+	targetURL, _, err := proxy.buildTargetURL(req)
 
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
@@ -146,10 +190,10 @@ func TestBuildTargetURL_WithDefaultHost(t *testing.T) {
 }
 
 func TestBuildTargetURL_NoDefaultNoMapping(t *testing.T) {
-	proxy, _ := NewProxy("", nil)
+	proxy, _ := NewProxy("", nil, false, nil, "", nil, 0)
 
 	req := httptest.NewRequest("GET", "http://localhost/test", nil)
-	_, err := proxy.buildTargetURL(req)
+	_, _, err := proxy.buildTargetURL(req)
 
 	if err == nil {
 		t.Error("Expected error when no default host and no mapping match")
@@ -164,7 +208,7 @@ func TestServeHTTP_WithDefaultHost(t *testing.T) {
 	}))
 	defer backend.Close()
 
-	proxy, _ := NewProxy(backend.URL, nil)
+	proxy, _ := NewProxy(backend.URL, nil, false, nil, "", nil, 0)
 
 	req := httptest.NewRequest("GET", "http://localhost/test/path", nil)
 	req.Header.Set("User-Agent", "test-agent")
@@ -198,11 +242,11 @@ func TestServeHTTP_WithPathMapping(t *testing.T) {
 	}))
 	defer backend.Close()
 
-	mappings := []PathMapping{
+	routes := []Route{
 		{From: `/test/(\d+)`, To: backend.URL + `/mapped/$1`},
 	}
 
-	proxy, _ := NewProxy("https://default.com", mappings)
+	proxy, _ := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
 
 	req := httptest.NewRequest("GET", "http://localhost/test/456", nil)
 	w := httptest.NewRecorder()
@@ -227,11 +271,11 @@ func TestServeHTTP_WithPathMapping(t *testing.T) {
 
 func TestServeHTTP_HTTPSMapping(t *testing.T) {
 	// Use a real HTTPS endpoint for testing
-	mappings := []PathMapping{
+	routes := []Route{
 		{From: `/github/(.+)`, To: `https://httpbin.org/status/$1`},
 	}
 
-	proxy, _ := NewProxy("http://localhost", mappings)
+	proxy, _ := NewProxy("http://localhost", routes, false, nil, "", nil, 0)
 
 	req := httptest.NewRequest("GET", "http://localhost/github/200", nil)
 	w := httptest.NewRecorder()
@@ -255,7 +299,7 @@ func TestServeHTTP_PreservesQueryParams(t *testing.T) {
 	}))
 	defer backend.Close()
 
-	proxy, _ := NewProxy(backend.URL, nil)
+	proxy, _ := NewProxy(backend.URL, nil, false, nil, "", nil, 0)
 
 	req := httptest.NewRequest("GET", "http://localhost/path?key1=value1&key2=value2", nil)
 	w := httptest.NewRecorder()
@@ -277,7 +321,7 @@ func TestServeHTTP_PreservesHeaders(t *testing.T) {
 	}))
 	defer backend.Close()
 
-	proxy, _ := NewProxy(backend.URL, nil)
+	proxy, _ := NewProxy(backend.URL, nil, false, nil, "", nil, 0)
 
 	req := httptest.NewRequest("GET", "http://localhost/test", nil)
 	req.Header.Set("User-Agent", "test-agent")
@@ -295,10 +339,427 @@ func TestServeHTTP_PreservesHeaders(t *testing.T) {
 	}
 }
 
+func TestServeHTTP_RouteHeaderMiddleware(t *testing.T) {
+	var receivedHeaders http.Header
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaders = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	routes := []Route{
+		{
+			From:                 `/svc/(.*)`,
+			To:                   backend.URL + `/$1`,
+			SetRequestHeaders:    map[string]string{"X-Injected": "yes"},
+			RemoveRequestHeaders: []string{"X-Strip-Me"},
+			SetResponseHeaders:   map[string]string{"X-Served-By": "tcz-proxy"},
+		},
+	}
+
+	proxy, _ := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
+
+	req := httptest.NewRequest("GET", "http://localhost/svc/thing", nil)
+	req.Header.Set("X-Strip-Me", "should-not-arrive")
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	if got := receivedHeaders.Get("X-Injected"); got != "yes" {
+		t.Errorf("Expected X-Injected to be set on upstream request, got %q", got)
+	}
+	if got := receivedHeaders.Get("X-Strip-Me"); got != "" {
+		t.Errorf("Expected X-Strip-Me to be removed from upstream request, got %q", got)
+	}
+
+	resp := w.Result()
+	if got := resp.Header.Get("X-Served-By"); got != "tcz-proxy" {
+		t.Errorf("Expected X-Served-By to be set on the response, got %q", got)
+	}
+}
+
+func TestServeHTTP_RewriteHost(t *testing.T) {
+	var receivedHost string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedHost = r.Host
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	routes := []Route{
+		{From: `/svc/(.*)`, To: backend.URL + `/$1`, RewriteHost: "internal.example.com"},
+	}
+
+	proxy, _ := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
+
+	req := httptest.NewRequest("GET", "http://localhost/svc/thing", nil)
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	if receivedHost != "internal.example.com" {
+		t.Errorf("Expected Host header 'internal.example.com', got '%s'", receivedHost)
+	}
+}
+
+func TestServeHTTP_BasicAuth(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	routes := []Route{
+		{From: `/secure/(.*)`, To: backend.URL + `/$1`, BasicAuth: "admin"},
+	}
+	auth := map[string]BasicAuthConfig{
+		"admin": {Username: "admin", PasswordHash: string(hash)},
+	}
+
+	proxy, err := NewProxy("https://default.com", routes, false, auth, "", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	t.Run("No credentials", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost/secure/thing", nil)
+		w := httptest.NewRecorder()
+
+		proxy.ServeHTTP(w, req)
+
+		if w.Result().StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d", w.Result().StatusCode)
+		}
+	})
+
+	t.Run("Wrong password", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost/secure/thing", nil)
+		req.SetBasicAuth("admin", "wrong")
+		w := httptest.NewRecorder()
+
+		proxy.ServeHTTP(w, req)
+
+		if w.Result().StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d", w.Result().StatusCode)
+		}
+	})
+
+	t.Run("Correct credentials", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost/secure/thing", nil)
+		req.SetBasicAuth("admin", "s3cret")
+		w := httptest.NewRecorder()
+
+		proxy.ServeHTTP(w, req)
+
+		if w.Result().StatusCode != http.StatusOK {
+			t.Errorf("Expected 200, got %d", w.Result().StatusCode)
+		}
+	})
+
+	t.Run("Malformed Authorization header", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://localhost/secure/thing", nil)
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("not-user-colon-pass-form")))
+		w := httptest.NewRecorder()
+
+		proxy.ServeHTTP(w, req)
+
+		if w.Result().StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d", w.Result().StatusCode)
+		}
+	})
+}
+
+func TestServeHTTP_PerRouteFollowRedirects(t *testing.T) {
+	var redirectTarget string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, redirectTarget, http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("final destination"))
+	}))
+	defer backend.Close()
+	redirectTarget = backend.URL + "/final"
+
+	followRedirects := true
+	routes := []Route{
+		{From: `/follow/(.*)`, To: backend.URL + `/$1`, FollowRedirects: &followRedirects},
+	}
+
+	// Proxy-wide default is to not follow redirects, but the route opts in.
+	proxy, err := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/follow/redirect", nil)
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the route's client to follow the redirect to 200, got %d", resp.StatusCode)
+	}
+	if string(body) != "final destination" {
+		t.Errorf("Expected 'final destination', got '%s'", string(body))
+	}
+}
+
+func TestServeHTTP_InsecureUpstream(t *testing.T) {
+	// httptest.NewTLSServer presents a self-signed certificate, which a
+	// normal client would reject.
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("insecure upstream ok"))
+	}))
+	defer backend.Close()
+
+	insecureTarget := strings.Replace(backend.URL, "https://", "https+insecure://", 1)
+	routes := []Route{
+		{From: `/insecure/(.*)`, To: insecureTarget + `/$1`},
+	}
+
+	proxy, err := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/insecure/thing", nil)
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if string(body) != "insecure upstream ok" {
+		t.Errorf("Expected 'insecure upstream ok', got '%s'", string(body))
+	}
+}
+
+func TestServeHTTP_WebSocketEcho(t *testing.T) {
+	echoServer := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer echoServer.Close()
+
+	routes := []Route{
+		{From: `/ws/(.*)`, To: echoServer.URL + `/$1`},
+	}
+	proxy, err := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyServer.URL, "http://"))
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+
+	wsURL := "ws://" + strings.TrimPrefix(proxyServer.URL, "http://") + "/ws/echo"
+	config, err := websocket.NewConfig(wsURL, "http://localhost/")
+	if err != nil {
+		t.Fatalf("failed to build websocket config: %v", err)
+	}
+
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		t.Fatalf("websocket handshake through proxy failed: %v", err)
+	}
+	defer ws.Close()
+
+	if _, err := ws.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to write to websocket: %v", err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(ws, buf); err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("Expected echo 'hello', got '%s'", string(buf))
+	}
+}
+
+func TestServeHTTP_SSEStreaming(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		flusher := w.(http.Flusher)
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			flusher.Flush()
+		}
+	}))
+	defer backend.Close()
+
+	routes := []Route{
+		{From: `/events`, To: backend.URL + `/events`},
+	}
+	proxy, err := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/events", nil)
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected Content-Type 'text/event-stream', got %q", resp.Header.Get("Content-Type"))
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	expected := "data: 0\n\ndata: 1\n\ndata: 2\n\n"
+	if string(body) != expected {
+		t.Errorf("Expected SSE body %q, got %q", expected, string(body))
+	}
+}
+
+func TestServeHTTP_ForwardedHeaders(t *testing.T) {
+	var gotXFF, gotProto, gotHost string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotXFF = r.Header.Get("X-Forwarded-For")
+		gotProto = r.Header.Get("X-Forwarded-Proto")
+		gotHost = r.Header.Get("X-Forwarded-Host")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	proxy, _ := NewProxy(backend.URL, nil, false, nil, "", nil, 0)
+
+	req := httptest.NewRequest("GET", "http://gateway.example.com/test", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	req.RemoteAddr = "198.51.100.9:54321"
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	if gotXFF != "203.0.113.5, 198.51.100.9" {
+		t.Errorf("Expected X-Forwarded-For to append the new hop without its port, got %q", gotXFF)
+	}
+	if gotProto != "http" {
+		t.Errorf("Expected X-Forwarded-Proto 'http', got %q", gotProto)
+	}
+	if gotHost != "gateway.example.com" {
+		t.Errorf("Expected X-Forwarded-Host 'gateway.example.com', got %q", gotHost)
+	}
+}
+
+func TestServeHTTP_HopByHopHeadersStripped(t *testing.T) {
+	var gotConnection, gotTE string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotConnection = r.Header.Get("Connection")
+		gotTE = r.Header.Get("X-Should-Be-Stripped")
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	proxy, _ := NewProxy(backend.URL, nil, false, nil, "", nil, 0)
+
+	req := httptest.NewRequest("GET", "http://localhost/test", nil)
+	req.Header.Set("Connection", "X-Should-Be-Stripped")
+	req.Header.Set("X-Should-Be-Stripped", "yes")
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	if gotConnection != "" {
+		t.Errorf("Expected Connection header to be stripped from the upstream request, got %q", gotConnection)
+	}
+	if gotTE != "" {
+		t.Errorf("Expected the header named in Connection to be stripped too, got %q", gotTE)
+	}
+
+	resp := w.Result()
+	if resp.Header.Get("Connection") != "" {
+		t.Errorf("Expected Connection header to be stripped from the response, got %q", resp.Header.Get("Connection"))
+	}
+	if resp.Header.Get("Keep-Alive") != "" {
+		t.Errorf("Expected Keep-Alive header to be stripped from the response, got %q", resp.Header.Get("Keep-Alive"))
+	}
+}
+
+func TestNewProxy_ProxyURL(t *testing.T) {
+	routes := []Route{
+		{From: `/default/(.*)`, To: `https://example.com/$1`},
+		{From: `/override/(.*)`, To: `https://internal.example.com/$1`, ProxyURL: "http://route-proxy.local:3128"},
+	}
+
+	proxy, err := NewProxy("https://default.com", routes, false, nil, "http://corp-proxy.local:3128", map[string]string{"Proxy-Authorization": "Bearer secret"}, 0)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+
+	defaultTransport, ok := proxy.client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("Expected proxy.client.Transport to be an *http.Transport")
+	}
+	req := httptest.NewRequest("GET", "https://example.com/thing", nil)
+	proxyURL, err := defaultTransport.Proxy(req)
+	if err != nil {
+		t.Fatalf("Proxy func returned error: %v", err)
+	}
+	if proxyURL == nil || proxyURL.String() != "http://corp-proxy.local:3128" {
+		t.Errorf("Expected default client to use the configured proxy_url, got %v", proxyURL)
+	}
+	if got := defaultTransport.ProxyConnectHeader.Get("Proxy-Authorization"); got != "Bearer secret" {
+		t.Errorf("Expected ProxyConnectHeader to carry Proxy-Authorization, got %q", got)
+	}
+
+	cr, _, found := proxy.findRoute("/override/thing")
+	if !found {
+		t.Fatal("Expected the override route to match")
+	}
+	if cr.client == nil {
+		t.Fatal("Expected the route with its own proxy_url to have a dedicated client")
+	}
+	routeTransport, ok := cr.client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("Expected cr.client.Transport to be an *http.Transport")
+	}
+	routeProxyURL, err := routeTransport.Proxy(req)
+	if err != nil {
+		t.Fatalf("Proxy func returned error: %v", err)
+	}
+	if routeProxyURL == nil || routeProxyURL.String() != "http://route-proxy.local:3128" {
+		t.Errorf("Expected the route to use its own proxy_url, got %v", routeProxyURL)
+	}
+}
+
+func TestNewProxy_InvalidProxyURL(t *testing.T) {
+	_, err := NewProxy("https://default.com", nil, false, nil, "://not-a-url", nil, 0)
+	if err == nil {
+		t.Error("Expected error for invalid proxy_url")
+	}
+}
+
 func TestLoadConfig(t *testing.T) {
 	// Create a temporary config file
 	configContent := `default_host: https://example.com
-path_mappings:
+routes:
   - from: /test/(\d+)
     to: https://mapped.com/$1
   - from: /api/(.+)
@@ -327,16 +788,227 @@ path_mappings:
 		t.Errorf("Expected default host 'https://example.com', got '%s'", config.DefaultHost)
 	}
 
-	if len(config.PathMappings) != 2 {
-		t.Errorf("Expected 2 path mappings, got %d", len(config.PathMappings))
+	if len(config.Routes) != 2 {
+		t.Errorf("Expected 2 routes, got %d", len(config.Routes))
+	}
+
+	if config.Routes[0].From != `/test/(\d+)` {
+		t.Errorf("Expected first route from '/test/(\\d+)', got '%s'", config.Routes[0].From)
+	}
+
+	if config.Routes[0].To != `https://mapped.com/$1` {
+		t.Errorf("Expected first route to 'https://mapped.com/$1', got '%s'", config.Routes[0].To)
+	}
+}
+
+func TestLoadConfig_WithAuthAndMiddleware(t *testing.T) {
+	configContent := `default_host: https://example.com
+auth:
+  admin:
+    username: admin
+    password_hash: "$2a$10$abcdefghijklmnopqrstuv"
+routes:
+  - from: /secure/(.*)
+    to: https://internal.example.com/$1
+    basic_auth: admin
+    rewrite_host: internal.example.com
+    set_request_headers:
+      X-Injected: yes
+    remove_request_headers:
+      - X-Strip-Me
+    set_response_headers:
+      X-Served-By: tcz-proxy
+`
+
+	tmpfile, err := os.CreateTemp("", "config*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(configContent)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	cred, ok := config.Auth["admin"]
+	if !ok {
+		t.Fatal("Expected an 'admin' auth entry")
+	}
+	if cred.Username != "admin" {
+		t.Errorf("Expected username 'admin', got '%s'", cred.Username)
+	}
+
+	if len(config.Routes) != 1 {
+		t.Fatalf("Expected 1 route, got %d", len(config.Routes))
+	}
+	route := config.Routes[0]
+	if route.BasicAuth != "admin" {
+		t.Errorf("Expected basic_auth 'admin', got '%s'", route.BasicAuth)
+	}
+	if route.RewriteHost != "internal.example.com" {
+		t.Errorf("Expected rewrite_host 'internal.example.com', got '%s'", route.RewriteHost)
+	}
+	if route.SetRequestHeaders["X-Injected"] != "yes" {
+		t.Errorf("Expected set_request_headers to include X-Injected=yes, got %v", route.SetRequestHeaders)
+	}
+	if len(route.RemoveRequestHeaders) != 1 || route.RemoveRequestHeaders[0] != "X-Strip-Me" {
+		t.Errorf("Expected remove_request_headers to be [X-Strip-Me], got %v", route.RemoveRequestHeaders)
+	}
+	if route.SetResponseHeaders["X-Served-By"] != "tcz-proxy" {
+		t.Errorf("Expected set_response_headers to include X-Served-By=tcz-proxy, got %v", route.SetResponseHeaders)
+	}
+}
+
+func TestLoadConfig_WithTLS(t *testing.T) {
+	configContent := `default_host: https://example.com
+tls:
+  addr: ":8443"
+  autocert:
+    cache_dir: /var/cache/tcz-proxy/certs
+    hosts:
+      - mirror.example.com
+`
+
+	tmpfile, err := os.CreateTemp("", "config*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(configContent)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if config.TLS == nil {
+		t.Fatal("Expected a tls section")
+	}
+	if config.TLS.Addr != ":8443" {
+		t.Errorf("Expected addr ':8443', got '%s'", config.TLS.Addr)
+	}
+	if config.TLS.AutoCert == nil {
+		t.Fatal("Expected an autocert section")
+	}
+	if config.TLS.AutoCert.CacheDir != "/var/cache/tcz-proxy/certs" {
+		t.Errorf("Expected cache_dir '/var/cache/tcz-proxy/certs', got '%s'", config.TLS.AutoCert.CacheDir)
+	}
+	if len(config.TLS.AutoCert.Hosts) != 1 || config.TLS.AutoCert.Hosts[0] != "mirror.example.com" {
+		t.Errorf("Expected hosts ['mirror.example.com'], got %v", config.TLS.AutoCert.Hosts)
+	}
+}
+
+func TestLoadConfig_WithProxyURL(t *testing.T) {
+	configContent := `default_host: https://example.com
+proxy_url: http://corp-proxy.local:3128
+proxy_connect_header:
+  Proxy-Authorization: "Bearer secret"
+routes:
+  - from: /internal/(.*)
+    to: https://internal.example.com/$1
+    proxy_url: http://route-proxy.local:3128
+`
+
+	tmpfile, err := os.CreateTemp("", "config*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(configContent)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if config.ProxyURL != "http://corp-proxy.local:3128" {
+		t.Errorf("Expected proxy_url 'http://corp-proxy.local:3128', got '%s'", config.ProxyURL)
+	}
+	if config.ProxyConnectHeader["Proxy-Authorization"] != "Bearer secret" {
+		t.Errorf("Expected proxy_connect_header to include Proxy-Authorization, got %v", config.ProxyConnectHeader)
+	}
+	if len(config.Routes) != 1 || config.Routes[0].ProxyURL != "http://route-proxy.local:3128" {
+		t.Errorf("Expected route proxy_url 'http://route-proxy.local:3128', got %v", config.Routes)
+	}
+}
+
+func TestLoadConfig_WithFlushInterval(t *testing.T) {
+	configContent := `default_host: https://example.com
+flush_interval: 100ms
+`
+
+	tmpfile, err := os.CreateTemp("", "config*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(configContent)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if time.Duration(config.FlushInterval) != 100*time.Millisecond {
+		t.Errorf("Expected flush_interval 100ms, got %v", time.Duration(config.FlushInterval))
 	}
+}
+
+func TestLoadConfig_WithAdminAddrAndLogFormat(t *testing.T) {
+	configContent := `default_host: https://example.com
+admin_addr: ":9090"
+log_format: json
+`
 
-	if config.PathMappings[0].From != `/test/(\d+)` {
-		t.Errorf("Expected first mapping from '/test/(\\d+)', got '%s'", config.PathMappings[0].From)
+	tmpfile, err := os.CreateTemp("", "config*.yaml")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.Remove(tmpfile.Name())
 
-	if config.PathMappings[0].To != `https://mapped.com/$1` {
-		t.Errorf("Expected first mapping to 'https://mapped.com/$1', got '%s'", config.PathMappings[0].To)
+	if _, err := tmpfile.Write([]byte(configContent)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := loadConfig(tmpfile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if config.AdminAddr != ":9090" {
+		t.Errorf("Expected admin_addr ':9090', got %q", config.AdminAddr)
+	}
+	if config.LogFormat != "json" {
+		t.Errorf("Expected log_format 'json', got %q", config.LogFormat)
 	}
 }
 
@@ -369,11 +1041,11 @@ func TestLoadConfig_InvalidYAML(t *testing.T) {
 }
 
 func TestComplexRegexMapping(t *testing.T) {
-	mappings := []PathMapping{
+	routes := []Route{
 		{From: `.*/(\d+)\.x/(aarch64|armhf)/tcz/watchdog\.tcz`, To: `https://github.com/asssaf/picore-watchdog/releases/download/$1/watchdog-$2.zip`},
 	}
 
-	proxy, err := NewProxy("https://default.com", mappings)
+	proxy, err := NewProxy("https://default.com", routes, false, nil, "", nil, 0)
 	if err != nil {
 		t.Fatalf("Failed to create proxy: %v", err)
 	}
@@ -394,7 +1066,7 @@ func TestComplexRegexMapping(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.path, func(t *testing.T) {
-			result, found := proxy.findMapping(tt.path)
+			_, result, found := proxy.findRoute(tt.path)
 			if !found {
 				t.Error("Expected to find mapping")
 			}
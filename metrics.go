@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors for one Proxy instance. Each
+// config reload builds a new Proxy (see ConfigWatcher), and so a new
+// Metrics with its counters reset to zero - consistent with the rest of a
+// reload's state (compiled routes, clients, auth) being rebuilt from
+// scratch rather than carried over.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requestsTotal   *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	upstreamErrors  *prometheus.CounterVec
+	inFlight        prometheus.Gauge
+}
+
+func newMetrics() *Metrics {
+	registry := prometheus.NewRegistry()
+
+	m := &Metrics{
+		registry: registry,
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tczproxy_requests_total",
+			Help: "Total number of requests handled, by route, method and response code.",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tczproxy_request_duration_seconds",
+			Help:    "Request handling duration in seconds, by route and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tczproxy_upstream_errors_total",
+			Help: "Total number of failed upstream requests, by route and failure reason.",
+		}, []string{"route", "reason"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tczproxy_in_flight_requests",
+			Help: "Number of requests currently being proxied.",
+		}),
+	}
+
+	registry.MustRegister(m.requestsTotal, m.requestDuration, m.upstreamErrors, m.inFlight)
+	return m
+}
+
+// Handler serves m's collectors in the Prometheus text exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) observeRequest(route, method, code string, duration time.Duration) {
+	m.requestsTotal.WithLabelValues(route, method, code).Inc()
+	m.requestDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+}
+
+func (m *Metrics) observeUpstreamError(route, reason string) {
+	m.upstreamErrors.WithLabelValues(route, reason).Inc()
+}
+
+// classifyUpstreamError buckets err into one of the reasons tracked by
+// tczproxy_upstream_errors_total: "dns", "tls", "timeout" or "connect",
+// falling back to "other" for anything unrecognized.
+func classifyUpstreamError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
+
+	var hostnameErr x509.HostnameError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var certInvalidErr x509.CertificateInvalidError
+	var tlsRecordErr tls.RecordHeaderError
+	if errors.As(err, &hostnameErr) || errors.As(err, &unknownAuthErr) ||
+		errors.As(err, &certInvalidErr) || errors.As(err, &tlsRecordErr) {
+		return "tls"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return "connect"
+	}
+
+	return "other"
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status code and
+// byte count written, for per-request metrics and logging. It forwards
+// Flush and Hijack so SSE streaming and WebSocket upgrades (see
+// routeClientTransport) keep working through the wrapper.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	return h.Hijack()
+}
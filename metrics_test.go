@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClassifyUpstreamError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"dns", &net.DNSError{Err: "no such host", Name: "example.invalid"}, "dns"},
+		{"timeout", &net.OpError{Op: "read", Err: timeoutError{}}, "timeout"},
+		{"connect", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, "connect"},
+		{"other", errors.New("boom"), "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyUpstreamError(tt.err); got != tt.want {
+				t.Errorf("classifyUpstreamError(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestServeHTTP_RecordsMetrics(t *testing.T) {
+	backend := httptest.NewServer(nil)
+	backend.Close() // force a connect failure, which the ErrorHandler should count
+
+	routes := []Route{
+		{From: `/test`, To: backend.URL + `/test`},
+	}
+	proxy, err := NewProxy("", routes, false, nil, "", nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/test", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	metricsReq := httptest.NewRequest("GET", "/metrics", nil)
+	metricsW := httptest.NewRecorder()
+	proxy.metrics.Handler().ServeHTTP(metricsW, metricsReq)
+
+	body, err := io.ReadAll(metricsW.Result().Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics body: %v", err)
+	}
+
+	for _, want := range []string{
+		"tczproxy_requests_total",
+		"tczproxy_request_duration_seconds",
+		"tczproxy_upstream_errors_total",
+		"tczproxy_in_flight_requests",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected /metrics output to contain %q, got:\n%s", want, body)
+		}
+	}
+}
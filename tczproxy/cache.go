@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cacheableSuffixes lists the TCZ artifacts worth keeping on disk once
+// fetched - that's the whole point of running a mirror proxy.
+var cacheableSuffixes = []string{".tcz", ".tcz.md5.txt", ".tcz.info", ".tcz.dep"}
+
+func isCacheable(path string) bool {
+	for _, suf := range cacheableSuffixes {
+		if strings.HasSuffix(path, suf) {
+			return true
+		}
+	}
+	return false
+}
+
+const defaultNegativeTTL = 30 * time.Second
+
+// fileCache is an on-disk store of successfully fetched TCZ artifacts, keyed
+// by the sha256 of their target URL, plus short-lived negative entries for
+// 404s. It is nil (and caching is a no-op) when no cache_dir is configured.
+type fileCache struct {
+	dir         string
+	maxBytes    int64
+	ttl         time.Duration
+	negativeTTL time.Duration
+}
+
+func newFileCache(cfg CacheConfig) (*fileCache, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	negativeTTL := time.Duration(cfg.NegativeTTL)
+	if negativeTTL == 0 {
+		negativeTTL = defaultNegativeTTL
+	}
+
+	return &fileCache{
+		dir:         cfg.Dir,
+		maxBytes:    cfg.MaxBytes,
+		ttl:         time.Duration(cfg.TTL),
+		negativeTTL: negativeTTL,
+	}, nil
+}
+
+// cacheMeta is the sidecar JSON stored alongside each cached entry's data
+// file, describing enough of the response to replay it later.
+type cacheMeta struct {
+	URL         string    `json:"url"`
+	StatusCode  int       `json:"status_code"`
+	ContentType string    `json:"content_type,omitempty"`
+	ETag        string    `json:"etag,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+func (c *fileCache) key(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *fileCache) dataPath(key string) string { return filepath.Join(c.dir, key+".data") }
+func (c *fileCache) metaPath(key string) string { return filepath.Join(c.dir, key+".meta.json") }
+
+// load returns the metadata for url if a still-fresh entry exists, evicting
+// it first if its TTL (or negativeTTL, for cached 404s) has elapsed.
+func (c *fileCache) load(url string) (*cacheMeta, bool) {
+	data, err := os.ReadFile(c.metaPath(c.key(url)))
+	if err != nil {
+		return nil, false
+	}
+
+	var meta cacheMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, false
+	}
+
+	ttl := c.ttl
+	if meta.StatusCode == http.StatusNotFound {
+		ttl = c.negativeTTL
+	}
+	if ttl > 0 && time.Since(meta.FetchedAt) > ttl {
+		c.evict(url)
+		return nil, false
+	}
+
+	return &meta, true
+}
+
+func (c *fileCache) evict(url string) {
+	key := c.key(url)
+	os.Remove(c.dataPath(key))
+	os.Remove(c.metaPath(key))
+}
+
+func (c *fileCache) writeMeta(meta cacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.metaPath(c.key(meta.URL)), data, 0o644)
+}
+
+func (c *fileCache) storeNegative(url string) {
+	c.writeMeta(cacheMeta{URL: url, StatusCode: http.StatusNotFound, FetchedAt: time.Now()})
+}
+
+// serve replies from the cached data file for a cache hit, honoring
+// If-Modified-Since and If-None-Match via http.ServeContent.
+func (c *fileCache) serve(w http.ResponseWriter, r *http.Request, url string, meta *cacheMeta) {
+	if meta.StatusCode == http.StatusNotFound {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(c.dataPath(c.key(url)))
+	if err != nil {
+		c.evict(url)
+		http.Error(w, "cache read error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "cache read error", http.StatusInternalServerError)
+		return
+	}
+
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+	if meta.ETag != "" {
+		w.Header().Set("ETag", meta.ETag)
+	}
+
+	http.ServeContent(w, r, filepath.Base(r.URL.Path), info.ModTime(), f)
+}
+
+// expectedMD5 reads the digest out of a cached "<tczURL>.md5.txt" sidecar,
+// if one has already been fetched. Tiny Core's .md5.txt files are a single
+// "<digest>  <filename>" line.
+func (c *fileCache) expectedMD5(tczURL string) (string, bool) {
+	meta, ok := c.load(tczURL + ".md5.txt")
+	if !ok || meta.StatusCode != http.StatusOK {
+		return "", false
+	}
+
+	data, err := os.ReadFile(c.dataPath(c.key(tczURL + ".md5.txt")))
+	if err != nil {
+		return "", false
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", false
+	}
+	return fields[0], true
+}
+
+// commit writes a successful response to the client and, cache permitting,
+// to disk. For plain files it tees the two writes so nothing is held in
+// memory. For a .tcz whose MD5 sidecar is already cached, it buffers to a
+// temp file and verifies the digest before writing anything to the client,
+// so a mismatch can be reported back as "try the next mirror" rather than
+// corrupting a response already in flight. It returns false only in that
+// last case - on a digest mismatch, or an error while buffering or
+// reopening the temp file - with nothing written to the client, meaning the
+// caller should retry against another source.
+//
+// A response of unknown length (chunked, or simply missing Content-Length)
+// is treated the same as one known to exceed maxBytes: served but not
+// cached, since there's no size to check against and caching it anyway
+// would let an unbounded download fill cache_dir.
+func (c *fileCache) commit(w http.ResponseWriter, resp *http.Response, url string) (bool, error) {
+	if c.maxBytes > 0 && (resp.ContentLength < 0 || resp.ContentLength > c.maxBytes) {
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		_, err := io.Copy(w, resp.Body)
+		return true, err
+	}
+
+	if expected, ok := c.expectedMD5(url); strings.HasSuffix(url, ".tcz") && ok {
+		return c.commitBuffered(w, resp, url, expected)
+	}
+	return c.commitStreaming(w, resp, url)
+}
+
+func (c *fileCache) commitStreaming(w http.ResponseWriter, resp *http.Response, url string) (bool, error) {
+	key := c.key(url)
+	tmp, err := os.CreateTemp(c.dir, key+".tmp-*")
+	if err != nil {
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		_, cerr := io.Copy(w, resp.Body)
+		return true, cerr
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once renamed into place
+
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := io.Copy(w, io.TeeReader(resp.Body, tmp)); err != nil {
+		tmp.Close()
+		return true, err
+	}
+	if err := tmp.Close(); err != nil {
+		return true, err
+	}
+
+	if err := os.Rename(tmpPath, c.dataPath(key)); err != nil {
+		return true, err
+	}
+
+	return true, c.writeMeta(cacheMeta{
+		URL:         url,
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+		FetchedAt:   time.Now(),
+	})
+}
+
+func (c *fileCache) commitBuffered(w http.ResponseWriter, resp *http.Response, url, expectedMD5 string) (bool, error) {
+	key := c.key(url)
+	tmp, err := os.CreateTemp(c.dir, key+".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	hasher := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), resp.Body); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+
+	if !strings.EqualFold(expectedMD5, hex.EncodeToString(hasher.Sum(nil))) {
+		return false, nil
+	}
+
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, f); err != nil {
+		return true, err
+	}
+
+	if err := os.Rename(tmpPath, c.dataPath(key)); err != nil {
+		return true, err
+	}
+
+	return true, c.writeMeta(cacheMeta{
+		URL:         url,
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+		FetchedAt:   time.Now(),
+	})
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
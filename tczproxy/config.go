@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MirrorStrategy controls how Proxy falls back to mirrors when the origin
+// (or an earlier mirror) returns 404.
+type MirrorStrategy string
+
+const (
+	// StrategySequential tries the origin, then each mirror in turn,
+	// stopping at the first non-404 response. This is the default.
+	StrategySequential MirrorStrategy = "sequential"
+	// StrategyHedged tries the origin alone and only fans out to the
+	// mirrors, concurrently, once HedgeDelay elapses or the origin
+	// answers with a 404.
+	StrategyHedged MirrorStrategy = "hedged"
+	// StrategyParallel issues the origin and every mirror concurrently
+	// and takes whichever responds first with a non-404 status.
+	StrategyParallel MirrorStrategy = "parallel"
+)
+
+// duration wraps time.Duration so it can be set in YAML using Go's
+// duration syntax (e.g. "250ms") rather than a raw integer of nanoseconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", value.Value, err)
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+type Config struct {
+	Mirrors        []string          `yaml:"mirrors"`
+	MirrorStrategy MirrorStrategy    `yaml:"mirror_strategy"`
+	HedgeDelay     duration          `yaml:"hedge_delay"`
+	Cache          CacheConfig       `yaml:"cache"`
+	HealthCheck    HealthCheckConfig `yaml:"health_check"`
+}
+
+// CacheConfig configures the on-disk cache for fetched TCZ extensions. An
+// empty Dir disables caching entirely.
+type CacheConfig struct {
+	// Dir is the directory cached files and metadata are written to.
+	Dir string `yaml:"cache_dir"`
+	// MaxBytes skips caching (but still serves) responses larger than this
+	// size. Zero means unlimited.
+	MaxBytes int64 `yaml:"max_bytes"`
+	// TTL is how long a cached entry is served before being re-fetched.
+	// Zero means cached entries never expire.
+	TTL duration `yaml:"ttl"`
+	// NegativeTTL is how long a cached 404 is served before the upstream
+	// is re-probed. Defaults to 30s when unset.
+	NegativeTTL duration `yaml:"negative_ttl"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	return &config, nil
+}
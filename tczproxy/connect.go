@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+// serveConnect implements the HTTP CONNECT method used to tunnel HTTPS (or
+// any other TCP traffic) through the proxy, e.g.
+// `curl -x http://localhost:8080 https://example.com`. It dials the
+// requested host, tells the client the tunnel is established, then
+// splices the two connections together until either side closes.
+func (p *Proxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	destConn, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, "Failed to reach target server", http.StatusBadGateway)
+		log.Printf("Error dialing CONNECT target %s: %v", r.Host, err)
+		return
+	}
+	defer destConn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking connection for CONNECT %s: %v", r.Host, err)
+		return
+	}
+	defer clientConn.Close()
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		log.Printf("Error writing CONNECT response for %s: %v", r.Host, err)
+		return
+	}
+
+	log.Printf("Established CONNECT tunnel to %s", r.Host)
+	splice(clientConn, destConn)
+	log.Printf("Completed: CONNECT %s", r.Host)
+}
+
+// splice copies bytes in both directions between a and b, as used for
+// CONNECT tunnels, returning once either side has finished.
+func splice(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	copyAndSignal := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+
+	go copyAndSignal(a, b)
+	go copyAndSignal(b, a)
+	<-done
+}
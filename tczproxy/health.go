@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// circuitBreakerThreshold is how many consecutive probe failures trip a
+// mirror's circuit open, taking it out of rotation until its cooldown
+// elapses.
+const circuitBreakerThreshold = 3
+
+// ewmaAlpha weights how quickly a mirror's latency estimate reacts to a
+// new probe sample versus its prior history.
+const ewmaAlpha = 0.3
+
+const (
+	defaultProbePath     = "/"
+	defaultProbeCooldown = 30 * time.Second
+	defaultProbeTimeout  = 3 * time.Second
+)
+
+// HealthCheckConfig configures the background mirror prober. A zero
+// Interval disables the periodic goroutine started by NewProxy; health
+// state can still be refreshed on demand.
+type HealthCheckConfig struct {
+	// ProbePath is the path probed on each mirror, via HEAD. Defaults to "/".
+	ProbePath string `yaml:"probe_path"`
+	// Interval is how often every mirror is probed. Zero disables the
+	// background prober.
+	Interval duration `yaml:"probe_interval"`
+	// Cooldown is how long a mirror's circuit stays open once tripped.
+	// Defaults to 30s when unset.
+	Cooldown duration `yaml:"cooldown"`
+	// Timeout bounds each individual probe request. Defaults to 3s.
+	Timeout duration `yaml:"probe_timeout"`
+}
+
+// mirrorHealth is one mirror's rolling health: EWMA probe latency,
+// consecutive failures, and whether its circuit breaker is currently open.
+type mirrorHealth struct {
+	mu               sync.Mutex
+	url              string
+	successCount     int
+	consecutiveFails int
+	latencyEWMA      time.Duration
+	lastGood         time.Time
+	circuitOpenUntil time.Time
+}
+
+func (h *mirrorHealth) recordSuccess(latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.successCount++
+	h.consecutiveFails = 0
+	h.lastGood = time.Now()
+	h.circuitOpenUntil = time.Time{}
+	if h.latencyEWMA == 0 {
+		h.latencyEWMA = latency
+	} else {
+		h.latencyEWMA = time.Duration(ewmaAlpha*float64(latency) + (1-ewmaAlpha)*float64(h.latencyEWMA))
+	}
+}
+
+func (h *mirrorHealth) recordFailure(cooldown time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.consecutiveFails++
+	if h.consecutiveFails >= circuitBreakerThreshold {
+		h.circuitOpenUntil = time.Now().Add(cooldown)
+	}
+}
+
+func (h *mirrorHealth) healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Now().After(h.circuitOpenUntil)
+}
+
+func (h *mirrorHealth) snapshot() mirrorStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return mirrorStats{
+		URL:              h.url,
+		SuccessCount:     h.successCount,
+		ConsecutiveFails: h.consecutiveFails,
+		LatencyMillis:    float64(h.latencyEWMA) / float64(time.Millisecond),
+		LastGood:         h.lastGood,
+		CircuitOpen:      time.Now().Before(h.circuitOpenUntil),
+	}
+}
+
+// mirrorStats is the JSON view of a mirror's health exposed at
+// /__proxy/mirrors.
+type mirrorStats struct {
+	URL              string    `json:"url"`
+	SuccessCount     int       `json:"success_count"`
+	ConsecutiveFails int       `json:"consecutive_fails"`
+	LatencyMillis    float64   `json:"latency_ms"`
+	LastGood         time.Time `json:"last_good,omitempty"`
+	CircuitOpen      bool      `json:"circuit_open"`
+}
+
+// healthChecker probes a fixed set of mirrors on a timer and ranks them by
+// health so the fallback path can converge on the fastest working mirror
+// instead of always walking the static config order.
+type healthChecker struct {
+	mirrors      []mirrorTarget
+	health       map[string]*mirrorHealth
+	transportFor func(mirrorTarget) http.RoundTripper
+	probePath    string
+	interval     time.Duration
+	cooldown     time.Duration
+	timeout      time.Duration
+	stop         chan struct{}
+}
+
+func newHealthChecker(mirrors []mirrorTarget, transportFor func(mirrorTarget) http.RoundTripper, cfg HealthCheckConfig) *healthChecker {
+	probePath := cfg.ProbePath
+	if probePath == "" {
+		probePath = defaultProbePath
+	}
+	cooldown := time.Duration(cfg.Cooldown)
+	if cooldown == 0 {
+		cooldown = defaultProbeCooldown
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout == 0 {
+		timeout = defaultProbeTimeout
+	}
+
+	hc := &healthChecker{
+		mirrors:      mirrors,
+		health:       make(map[string]*mirrorHealth, len(mirrors)),
+		transportFor: transportFor,
+		probePath:    probePath,
+		interval:     time.Duration(cfg.Interval),
+		cooldown:     cooldown,
+		timeout:      timeout,
+		stop:         make(chan struct{}),
+	}
+	for _, m := range mirrors {
+		hc.health[m.url] = &mirrorHealth{url: m.url}
+	}
+	return hc
+}
+
+// start launches the background prober, if an interval was configured. It
+// probes once immediately so ranking is informed from the first request
+// onward rather than only after the first tick.
+func (hc *healthChecker) start() {
+	if hc.interval <= 0 || len(hc.mirrors) == 0 {
+		return
+	}
+
+	go func() {
+		hc.probeAll()
+
+		ticker := time.NewTicker(hc.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				hc.probeAll()
+			case <-hc.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the background prober. It is safe to call even if start was
+// never called (e.g. no interval configured).
+func (hc *healthChecker) Stop() {
+	select {
+	case <-hc.stop:
+	default:
+		close(hc.stop)
+	}
+}
+
+func (hc *healthChecker) probeAll() {
+	var wg sync.WaitGroup
+	for _, m := range hc.mirrors {
+		m := m
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hc.probe(m)
+		}()
+	}
+	wg.Wait()
+}
+
+func (hc *healthChecker) probe(m mirrorTarget) {
+	h := hc.health[m.url]
+
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, strings.TrimSuffix(m.url, "/")+hc.probePath, nil)
+	if err != nil {
+		h.recordFailure(hc.cooldown)
+		return
+	}
+
+	start := time.Now()
+	resp, err := hc.transportFor(m).RoundTrip(req)
+	latency := time.Since(start)
+	if err != nil {
+		h.recordFailure(hc.cooldown)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		h.recordFailure(hc.cooldown)
+		return
+	}
+	h.recordSuccess(latency)
+}
+
+// rankTier buckets a mirror's snapshot so comparisons are "good mirrors by
+// latency, then recently-failing-but-not-yet-circuit-broken mirrors, then
+// fully circuit-broken ones" rather than only ever looking at latency.
+func (s mirrorStats) rankTier() int {
+	switch {
+	case s.CircuitOpen:
+		return 2
+	case s.ConsecutiveFails > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ranked returns the configured mirrors reordered healthy-first, then by
+// ascending latency, preserving config order as a tiebreaker. Mirrors
+// whose circuit is open are not dropped - they are only deprioritized -
+// so a request still has somewhere to go if every mirror looks unhealthy.
+func (hc *healthChecker) ranked() []mirrorTarget {
+	out := make([]mirrorTarget, len(hc.mirrors))
+	copy(out, hc.mirrors)
+
+	sort.SliceStable(out, func(i, j int) bool {
+		si, sj := hc.health[out[i].url].snapshot(), hc.health[out[j].url].snapshot()
+		if ti, tj := si.rankTier(), sj.rankTier(); ti != tj {
+			return ti < tj
+		}
+		return si.LatencyMillis < sj.LatencyMillis
+	})
+	return out
+}
+
+func (hc *healthChecker) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := make([]mirrorStats, 0, len(hc.mirrors))
+	for _, m := range hc.mirrors {
+		stats = append(stats, hc.health[m.url].snapshot())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// insecureScheme is the `https+insecure://` convention borrowed from
+// Tailscale's expandProxyArg: it means "use HTTPS but skip certificate
+// verification", which is handy for picore/tcz mirror hosts that serve
+// over self-signed certs on the LAN.
+const insecureScheme = "https+insecure://"
+
+// mirrorTarget is a mirror address resolved to a concrete URL plus
+// whether it should be dialed with certificate verification disabled.
+type mirrorTarget struct {
+	url      string
+	insecure bool
+}
+
+// expandMirrorArg normalizes a configured mirror address into a full URL.
+// It accepts plain http(s):// URLs, `https+insecure://host` for
+// self-signed HTTPS mirrors, bare "host:port" pairs, and bare numeric
+// ports (shorthand for 127.0.0.1:port, useful for local testing).
+func expandMirrorArg(arg string) mirrorTarget {
+	if strings.HasPrefix(arg, insecureScheme) {
+		return mirrorTarget{
+			url:      "https://" + strings.TrimPrefix(arg, insecureScheme),
+			insecure: true,
+		}
+	}
+
+	if strings.Contains(arg, "://") {
+		return mirrorTarget{url: arg}
+	}
+
+	if _, err := strconv.Atoi(arg); err == nil {
+		return mirrorTarget{url: "http://127.0.0.1:" + arg}
+	}
+
+	return mirrorTarget{url: "http://" + arg}
+}
@@ -1,162 +1,594 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"strings"
 	"time"
 )
 
 type Proxy struct {
-	client  *http.Client
+	rp      *httputil.ReverseProxy
 	mirrors []string
+	mt      *mirrorTransport
+	cache   *fileCache
+	health  *healthChecker
 }
 
-func NewProxy(mirrors []string) *Proxy {
-	return &Proxy{
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse // Don't follow redirects
-			},
+func NewProxy(mirrors []string, strategy MirrorStrategy, hedgeDelay time.Duration, cacheCfg CacheConfig, healthCfg HealthCheckConfig) (*Proxy, error) {
+	if strategy == "" {
+		strategy = StrategySequential
+	}
+
+	switch strategy {
+	case StrategySequential, StrategyHedged, StrategyParallel:
+	default:
+		return nil, fmt.Errorf("unknown mirror strategy %q", strategy)
+	}
+
+	targets := make([]mirrorTarget, len(mirrors))
+	for i, m := range mirrors {
+		targets[i] = expandMirrorArg(m)
+	}
+
+	cache, err := newFileCache(cacheCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up cache: %w", err)
+	}
+
+	p := &Proxy{mirrors: mirrors, cache: cache}
+
+	p.mt = &mirrorTransport{
+		secure:     http.DefaultTransport,
+		insecure:   &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		mirrors:    targets,
+		strategy:   strategy,
+		hedgeDelay: hedgeDelay,
+	}
+
+	if len(targets) > 0 {
+		p.health = newHealthChecker(targets, p.mt.transportFor, healthCfg)
+		p.mt.health = p.health
+		p.health.start()
+	}
+
+	p.rp = &httputil.ReverseProxy{
+		Director:  p.director,
+		Transport: p.mt,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			http.Error(w, "Failed to reach target server", http.StatusBadGateway)
+			log.Printf("Error sending request: %v", err)
 		},
-		mirrors: mirrors,
 	}
+
+	return p, nil
 }
 
-func (p *Proxy) tryRequest(targetURL string, r *http.Request) (*http.Response, error) {
-	proxyReq, err := http.NewRequest(r.Method, targetURL, nil)
-	if err != nil {
-		return nil, err
+// Close stops the background mirror prober, if one was started. It does
+// not close idle connections held by the proxy's transports.
+func (p *Proxy) Close() error {
+	if p.health != nil {
+		p.health.Stop()
+	}
+	return nil
+}
+
+// director rewrites the incoming request into the one that should be sent
+// upstream. When the proxy is used as a forward proxy (e.g. via
+// `curl -x http://localhost:8080 http://example.com`), r.URL already
+// carries the absolute target; otherwise fall back to the Host header.
+func (p *Proxy) director(r *http.Request) {
+	if r.URL.Scheme == "" {
+		r.URL.Scheme = "http"
 	}
+	if r.URL.Host == "" {
+		r.URL.Host = r.Host
+	}
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Proxying request: %s %s", r.Method, r.URL.String())
+
+	if r.URL.Path == "/__proxy/mirrors" {
+		p.serveMirrorStats(w, r)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r)
+		return
+	}
+
+	if p.cache != nil && r.Method == http.MethodGet && isCacheable(r.URL.Path) {
+		p.serveCached(w, r)
+		log.Printf("Completed: %s %s", r.Method, r.URL.String())
+		return
+	}
+
+	// Plain Upgrade requests (WebSocket, h2c, ...) are handled by
+	// httputil.ReverseProxy itself: it preserves the Connection/Upgrade
+	// headers across the hop-by-hop strip and splices the hijacked
+	// connection on a 101 response.
+	p.rp.ServeHTTP(w, r)
+	log.Printf("Completed: %s %s", r.Method, r.URL.String())
+}
 
-	// Copy headers from original request
-	for name, values := range r.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(name, value)
+// serveMirrorStats answers GET /__proxy/mirrors with the current health
+// and ranking of every configured mirror, for observability.
+func (p *Proxy) serveMirrorStats(w http.ResponseWriter, r *http.Request) {
+	if p.health == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+		return
+	}
+	p.health.statsHandler(w, r)
+}
+
+// targetURLString is the cache key for r: the absolute upstream URL it
+// resolves to, independent of which mirror eventually serves it.
+func targetURLString(r *http.Request) string {
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	u := url.URL{Scheme: scheme, Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	return u.String()
+}
+
+// serveCached answers a cacheable GET from disk when possible, and
+// otherwise fetches it from the origin and each mirror in turn, moving on
+// after a transport error, a 404 or a checksum mismatch. A 200 response is
+// cached for next time; any other status is relayed to the client as-is,
+// uncached, without trying the remaining sources.
+func (p *Proxy) serveCached(w http.ResponseWriter, r *http.Request) {
+	key := targetURLString(r)
+
+	if meta, ok := p.cache.load(key); ok {
+		p.cache.serve(w, r, key, meta)
+		return
+	}
+
+	outreq := r.Clone(r.Context())
+	p.director(outreq)
+
+	var lastResp *http.Response
+	var lastErr error
+
+	for i, cand := range p.fetchCandidates(outreq) {
+		resp, err := cand.transport.RoundTrip(cand.req)
+		if err != nil {
+			lastErr = err
+			log.Printf("Cache fetch attempt %d for %s failed: %v", i+1, key, err)
+			continue
 		}
+
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			lastResp = resp
+			continue
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			copyHeader(w.Header(), resp.Header)
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			resp.Body.Close()
+			return
+		}
+
+		ok, cerr := p.cache.commit(w, resp, key)
+		resp.Body.Close()
+		if cerr != nil {
+			log.Printf("Error caching %s: %v", key, cerr)
+		}
+		if ok {
+			return
+		}
+
+		log.Printf("Checksum mismatch fetching %s, trying next source", key)
+		lastResp = resp
 	}
 
-	// Add X-Forwarded-For header
-	if clientIP := r.RemoteAddr; clientIP != "" {
-		proxyReq.Header.Set("X-Forwarded-For", clientIP)
+	if lastResp != nil && lastResp.StatusCode == http.StatusNotFound {
+		p.cache.storeNegative(key)
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
 	}
 
-	return p.client.Do(proxyReq)
+	http.Error(w, "Failed to reach target server", http.StatusBadGateway)
+	if lastErr != nil {
+		log.Printf("Error fetching %s: %v", key, lastErr)
+	}
 }
 
-func (p *Proxy) replaceHost(originalURL, newHost string) (string, error) {
-	parsed, err := url.Parse(originalURL)
-	if err != nil {
-		return "", err
+// fetchCandidate pairs a request aimed at one source (the origin or a
+// mirror) with the transport that should send it.
+type fetchCandidate struct {
+	req       *http.Request
+	transport http.RoundTripper
+}
+
+// fetchCandidates lists the origin followed by every configured mirror, in
+// orderedMirrors' order, for a single cache fetch attempt. Unlike mirrorTransport it is not
+// limited to falling back on 404: the caller also falls through on a
+// checksum mismatch.
+func (p *Proxy) fetchCandidates(outreq *http.Request) []fetchCandidate {
+	candidates := []fetchCandidate{{req: outreq, transport: p.mt.secure}}
+
+	for _, mirror := range p.mt.orderedMirrors() {
+		mirrorReq, err := withMirror(outreq, mirror.url)
+		if err != nil {
+			log.Printf("Failed to create mirror URL for %s: %v", mirror.url, err)
+			continue
+		}
+		candidates = append(candidates, fetchCandidate{req: mirrorReq, transport: p.mt.transportFor(mirror)})
 	}
 
-	mirrorParsed, err := url.Parse(newHost)
+	return candidates
+}
+
+// mirrorTransport issues the request against the origin and falls back to
+// the configured mirrors on a 404 response, per strategy. Mirrors marked
+// insecure (via `https+insecure://`) are dialed through a transport with
+// certificate verification disabled; the origin always uses secure.
+type mirrorTransport struct {
+	secure     http.RoundTripper
+	insecure   http.RoundTripper
+	mirrors    []mirrorTarget
+	strategy   MirrorStrategy
+	hedgeDelay time.Duration
+	// health, when set, reorders mirrors by observed health/latency
+	// instead of always falling back in static config order.
+	health *healthChecker
+}
+
+func (t *mirrorTransport) transportFor(target mirrorTarget) http.RoundTripper {
+	if target.insecure {
+		return t.insecure
+	}
+	return t.secure
+}
+
+// orderedMirrors returns the mirrors to fall back to, ranked by health if
+// a healthChecker is configured, otherwise in static config order.
+func (t *mirrorTransport) orderedMirrors() []mirrorTarget {
+	if t.health != nil {
+		return t.health.ranked()
+	}
+	return t.mirrors
+}
+
+func (t *mirrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := drainBody(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	parsed.Scheme = mirrorParsed.Scheme
-	parsed.Host = mirrorParsed.Host
+	mirrors := t.orderedMirrors()
 
-	return parsed.String(), nil
+	switch t.strategy {
+	case StrategyHedged:
+		return t.roundTripHedged(req, body, mirrors)
+	case StrategyParallel:
+		return t.roundTripParallel(req, body, mirrors)
+	default:
+		return t.roundTripSequential(req, body, mirrors)
+	}
 }
 
-func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Proxying request: %s %s", r.Method, r.URL.String())
+func (t *mirrorTransport) roundTripSequential(req *http.Request, body []byte, mirrors []mirrorTarget) (*http.Response, error) {
+	resp, err := t.secure.RoundTrip(withBody(req, body))
+	if err != nil || resp.StatusCode != http.StatusNotFound || len(mirrors) == 0 {
+		return resp, err
+	}
 
-	// Create target URL
-	targetURL := r.URL.String()
-	if r.URL.Scheme == "" {
-		targetURL = "http://" + r.Host + r.URL.Path
-		if r.URL.RawQuery != "" {
-			targetURL += "?" + r.URL.RawQuery
+	log.Printf("Received 404, trying mirrors...")
+	for i, mirror := range mirrors {
+		// resp is nil here after a prior candidate failed with a transport
+		// error (RoundTrip never returns a response alongside an error).
+		if resp != nil {
+			resp.Body.Close()
 		}
+
+		mirrorReq, mErr := withMirror(req, mirror.url)
+		if mErr != nil {
+			log.Printf("Failed to create mirror URL for %s: %v", mirror.url, mErr)
+			continue
+		}
+
+		log.Printf("Trying mirror %d/%d: %s", i+1, len(mirrors), mirrorReq.URL)
+		mirrorResp, mErr := t.transportFor(mirror).RoundTrip(withBody(mirrorReq, body))
+		if mErr != nil {
+			log.Printf("Mirror %s failed: %v", mirror.url, mErr)
+			resp, err = nil, mErr
+			continue
+		}
+
+		if mirrorResp.StatusCode != http.StatusNotFound {
+			log.Printf("Mirror %s succeeded with status %d", mirror.url, mirrorResp.StatusCode)
+			return mirrorResp, nil
+		}
+
+		log.Printf("Mirror %s also returned 404", mirror.url)
+		resp, err = mirrorResp, nil
 	}
 
-	// Try original request
-	resp, err := p.tryRequest(targetURL, r)
-	if err != nil {
-		http.Error(w, "Failed to reach target server", http.StatusBadGateway)
-		log.Printf("Error sending request: %v", err)
-		return
+	return resp, err
+}
+
+// roundTripHedged races the origin alone, then fans out to every mirror,
+// concurrently, as soon as hedgeDelay elapses or the origin comes back
+// with a 404 - whichever happens first. The first non-404 response wins
+// and every other in-flight candidate is cancelled.
+func (t *mirrorTransport) roundTripHedged(req *http.Request, body []byte, mirrors []mirrorTarget) (*http.Response, error) {
+	results := make(chan raceResult, 1+len(mirrors))
+	var cancels []context.CancelFunc
+
+	// Each candidate gets its own context derived from req.Context(), not a
+	// single context shared by the whole race: cancelling a loser must not
+	// tear down the winner's response, which is still streaming its body
+	// back through httputil.ReverseProxy at the moment a winner is picked.
+	launch := func(base http.RoundTripper, r *http.Request) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		launchRace(ctx, len(cancels)-1, base, r, results)
 	}
 
-	// If we got a 404 and have mirrors, try them
-	if resp.StatusCode == http.StatusNotFound && len(p.mirrors) > 0 {
-		resp.Body.Close()
-		log.Printf("Received 404, trying mirrors...")
+	launch(t.secure, withBody(req, body))
+	pending := 1
 
-		for i, mirror := range p.mirrors {
-			mirrorURL, err := p.replaceHost(targetURL, mirror)
-			if err != nil {
-				log.Printf("Failed to create mirror URL for %s: %v", mirror, err)
+	fanOut := func() {
+		for _, mirror := range mirrors {
+			mirrorReq, mErr := withMirror(req, mirror.url)
+			if mErr != nil {
+				log.Printf("Failed to create mirror URL for %s: %v", mirror.url, mErr)
 				continue
 			}
+			launch(t.transportFor(mirror), withBody(mirrorReq, body))
+			pending++
+		}
+	}
 
-			log.Printf("Trying mirror %d/%d: %s", i+1, len(p.mirrors), mirrorURL)
-			mirrorResp, err := p.tryRequest(mirrorURL, r)
-			if err != nil {
-				log.Printf("Mirror %s failed: %v", mirror, err)
-				continue
+	timer := time.NewTimer(t.hedgeDelay)
+	defer timer.Stop()
+
+	var lastResp *http.Response
+	var lastErr error
+	lastIdx := -1
+	fannedOut := len(mirrors) == 0
+
+	for pending > 0 {
+		if fannedOut {
+			pending--
+			if winner, idx := collectRaceResult(<-results, &lastResp, &lastErr, &lastIdx, cancels); winner != nil {
+				cancelAllExcept(cancels, idx)
+				drainRace(results, pending)
+				return winner, nil
 			}
+			continue
+		}
 
-			// If we got something other than 404, use this response
-			if mirrorResp.StatusCode != http.StatusNotFound {
-				log.Printf("Mirror %s succeeded with status %d", mirror, mirrorResp.StatusCode)
-				resp = mirrorResp
-				break
+		select {
+		case res := <-results:
+			pending--
+			if winner, idx := collectRaceResult(res, &lastResp, &lastErr, &lastIdx, cancels); winner != nil {
+				cancelAllExcept(cancels, idx)
+				drainRace(results, pending)
+				return winner, nil
 			}
+			fannedOut = true
+			timer.Stop()
+			log.Printf("Origin returned 404, fanning out to mirrors...")
+			fanOut()
+		case <-timer.C:
+			fannedOut = true
+			log.Printf("Hedge delay elapsed, fanning out to mirrors...")
+			fanOut()
+		}
+	}
+
+	return lastResp, lastErr
+}
+
+// roundTripParallel issues the origin and every mirror concurrently and
+// takes whichever responds first with a non-404 status, cancelling the
+// rest.
+func (t *mirrorTransport) roundTripParallel(req *http.Request, body []byte, mirrors []mirrorTarget) (*http.Response, error) {
+	results := make(chan raceResult, 1+len(mirrors))
+	var cancels []context.CancelFunc
+
+	// Each candidate gets its own context derived from req.Context(), not a
+	// single context shared by the whole race: cancelling a loser must not
+	// tear down the winner's response, which is still streaming its body
+	// back through httputil.ReverseProxy at the moment a winner is picked.
+	launch := func(base http.RoundTripper, r *http.Request) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		launchRace(ctx, len(cancels)-1, base, r, results)
+	}
+
+	launch(t.secure, withBody(req, body))
+	pending := 1
+
+	for _, mirror := range mirrors {
+		mirrorReq, mErr := withMirror(req, mirror.url)
+		if mErr != nil {
+			log.Printf("Failed to create mirror URL for %s: %v", mirror.url, mErr)
+			continue
+		}
+		launch(t.transportFor(mirror), withBody(mirrorReq, body))
+		pending++
+	}
 
-			mirrorResp.Body.Close()
-			log.Printf("Mirror %s also returned 404", mirror)
+	var lastResp *http.Response
+	var lastErr error
+	lastIdx := -1
+	for pending > 0 {
+		pending--
+		if winner, idx := collectRaceResult(<-results, &lastResp, &lastErr, &lastIdx, cancels); winner != nil {
+			cancelAllExcept(cancels, idx)
+			drainRace(results, pending)
+			return winner, nil
 		}
 	}
 
-	defer resp.Body.Close()
+	return lastResp, lastErr
+}
+
+type raceResult struct {
+	index int
+	resp  *http.Response
+	err   error
+}
+
+// launchRace runs req in its own goroutine, bound to ctx, and delivers the
+// outcome - tagged with its candidate index among cancels, so the caller
+// can cancel individual losers without affecting the eventual winner - on
+// results.
+func launchRace(ctx context.Context, index int, base http.RoundTripper, req *http.Request, results chan<- raceResult) {
+	go func() {
+		resp, err := base.RoundTrip(req.WithContext(ctx))
+		results <- raceResult{index, resp, err}
+	}()
+}
 
-	// Copy response headers
-	for name, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(name, value)
+// collectRaceResult folds one race outcome into the running (lastResp,
+// lastErr, lastIdx) tuple and returns a non-nil response and its candidate
+// index only when res is a winner (a successful, non-404 response). A 404
+// that replaces a previously held lastResp cancels that previous
+// candidate's context, since its body has just been closed and is no
+// longer being read.
+func collectRaceResult(res raceResult, lastResp **http.Response, lastErr *error, lastIdx *int, cancels []context.CancelFunc) (*http.Response, int) {
+	if res.err != nil {
+		*lastErr = res.err
+		return nil, -1
+	}
+	if res.resp.StatusCode == http.StatusNotFound {
+		if *lastResp != nil {
+			(*lastResp).Body.Close()
+			cancels[*lastIdx]()
 		}
+		*lastResp = res.resp
+		*lastIdx = res.index
+		return nil, -1
 	}
+	return res.resp, res.index
+}
 
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
+// cancelAllExcept cancels every candidate's context except keep's, so the
+// rest of an in-progress race can be torn down without disturbing the
+// winner, whose response is being kept.
+func cancelAllExcept(cancels []context.CancelFunc, keep int) {
+	for i, cancel := range cancels {
+		if i != keep {
+			cancel()
+		}
+	}
+}
 
-	// Copy response body
-	_, err = io.Copy(w, resp.Body)
+// drainRace closes the body of every remaining in-flight candidate in the
+// background so a winner can be returned to the caller without waiting on
+// the losers to unwind.
+func drainRace(results <-chan raceResult, n int) {
+	if n <= 0 {
+		return
+	}
+	go func() {
+		for i := 0; i < n; i++ {
+			if res := <-results; res.err == nil {
+				res.resp.Body.Close()
+			}
+		}
+	}()
+}
+
+// drainBody reads and closes req.Body, returning its bytes so the request
+// can be replayed against the origin and, if needed, each mirror in turn.
+func drainBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	defer req.Body.Close()
+	return io.ReadAll(req.Body)
+}
+
+func withBody(req *http.Request, body []byte) *http.Request {
+	if body == nil {
+		return req
+	}
+	out := req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+	return out
+}
+
+func withMirror(req *http.Request, mirror string) (*http.Request, error) {
+	mirrorURL, err := url.Parse(mirror)
 	if err != nil {
-		log.Printf("Error copying response body: %v", err)
+		return nil, err
 	}
 
-	log.Printf("Completed: %s %s - Status: %d", r.Method, targetURL, resp.StatusCode)
+	out := req.Clone(req.Context())
+	out.URL.Scheme = mirrorURL.Scheme
+	out.URL.Host = mirrorURL.Host
+	out.Host = mirrorURL.Host
+	return out, nil
 }
 
 func main() {
-	// Define mirror servers - add your mirrors here
-	mirrors := []string{
-		"https://mirror1.example.com",
-		"https://mirror2.example.com",
-		"http://backup.example.com",
+	configFile := flag.String("config", "config.yaml", "Path to configuration file")
+	flag.Parse()
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Printf("Warning: Failed to load config file: %v", err)
+		config = &Config{
+			Mirrors: []string{
+				"https://mirror1.example.com",
+				"https://mirror2.example.com",
+				"http://backup.example.com",
+			},
+		}
 	}
 
 	// Filter out empty mirrors
 	var activeMirrors []string
-	for _, m := range mirrors {
+	for _, m := range config.Mirrors {
 		if strings.TrimSpace(m) != "" {
 			activeMirrors = append(activeMirrors, m)
 		}
 	}
 
-	proxy := NewProxy(activeMirrors)
+	hedgeDelay := time.Duration(config.HedgeDelay)
+	if hedgeDelay == 0 {
+		hedgeDelay = 250 * time.Millisecond
+	}
+
+	proxy, err := NewProxy(activeMirrors, config.MirrorStrategy, hedgeDelay, config.Cache, config.HealthCheck)
+	if err != nil {
+		log.Fatalf("Failed to create proxy: %v", err)
+	}
+	defer proxy.Close()
 
 	port := ":8080"
 	fmt.Printf("Starting HTTP proxy server on http://localhost%s\n", port)
+	strategy := config.MirrorStrategy
+	if strategy == "" {
+		strategy = StrategySequential
+	}
+	fmt.Printf("Mirror strategy: %s\n", strategy)
 	if len(activeMirrors) > 0 {
 		fmt.Printf("Configured mirrors (%d):\n", len(activeMirrors))
 		for i, m := range activeMirrors {
@@ -165,7 +597,16 @@ func main() {
 	} else {
 		fmt.Println("No mirrors configured - running as simple proxy")
 	}
+	if config.Cache.Dir != "" {
+		fmt.Printf("Caching TCZ artifacts in %s\n", config.Cache.Dir)
+	} else {
+		fmt.Println("Caching disabled (set cache_dir to enable)")
+	}
+	if len(activeMirrors) > 0 && time.Duration(config.HealthCheck.Interval) > 0 {
+		fmt.Printf("Mirror health checks enabled (every %s)\n", time.Duration(config.HealthCheck.Interval))
+	}
 	fmt.Println("\nExample usage: curl -x http://localhost:8080 http://example.com")
+	fmt.Println("Mirror health: curl http://localhost:8080/__proxy/mirrors")
 
 	if err := http.ListenAndServe(port, proxy); err != nil {
 		log.Fatal(err)
@@ -1,23 +1,40 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
 )
 
 func TestNewProxy(t *testing.T) {
 	mirrors := []string{"https://mirror1.com", "https://mirror2.com"}
-	proxy := NewProxy(mirrors)
+	proxy, err := NewProxy(mirrors, StrategySequential, 0, CacheConfig{}, HealthCheckConfig{})
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
 
 	if proxy == nil {
 		t.Fatal("NewProxy returned nil")
 	}
 
-	if proxy.client == nil {
-		t.Error("proxy.client is nil")
+	if proxy.rp == nil {
+		t.Error("proxy.rp is nil")
 	}
 
 	if len(proxy.mirrors) != 2 {
@@ -25,68 +42,134 @@ func TestNewProxy(t *testing.T) {
 	}
 }
 
-func TestReplaceHost(t *testing.T) {
-	proxy := NewProxy(nil)
+func mustNewProxy(t *testing.T, mirrors []string) *Proxy {
+	t.Helper()
+	proxy, err := NewProxy(mirrors, StrategySequential, 0, CacheConfig{}, HealthCheckConfig{})
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	return proxy
+}
+
+// mustNewCachingProxy is like mustNewProxy but enables the on-disk cache in
+// a temporary directory.
+func mustNewCachingProxy(t *testing.T, mirrors []string, cacheCfg CacheConfig) *Proxy {
+	t.Helper()
+	if cacheCfg.Dir == "" {
+		cacheCfg.Dir = t.TempDir()
+	}
+	proxy, err := NewProxy(mirrors, StrategySequential, 0, cacheCfg, HealthCheckConfig{})
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	return proxy
+}
 
+func TestExpandMirrorArg(t *testing.T) {
+	tests := []struct {
+		name     string
+		arg      string
+		expected mirrorTarget
+	}{
+		{
+			name:     "Plain HTTP URL",
+			arg:      "http://mirror.example.com",
+			expected: mirrorTarget{url: "http://mirror.example.com"},
+		},
+		{
+			name:     "Plain HTTPS URL",
+			arg:      "https://mirror.example.com",
+			expected: mirrorTarget{url: "https://mirror.example.com"},
+		},
+		{
+			name:     "https+insecure scheme",
+			arg:      "https+insecure://picore.lan",
+			expected: mirrorTarget{url: "https://picore.lan", insecure: true},
+		},
+		{
+			name:     "https+insecure scheme with port",
+			arg:      "https+insecure://picore.lan:8443",
+			expected: mirrorTarget{url: "https://picore.lan:8443", insecure: true},
+		},
+		{
+			name:     "Bare host:port",
+			arg:      "picore.lan:8080",
+			expected: mirrorTarget{url: "http://picore.lan:8080"},
+		},
+		{
+			name:     "Bare numeric port",
+			arg:      "3030",
+			expected: mirrorTarget{url: "http://127.0.0.1:3030"},
+		},
+		{
+			name:     "Bare hostname",
+			arg:      "mirror.example.com",
+			expected: mirrorTarget{url: "http://mirror.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := expandMirrorArg(tt.arg)
+			if result != tt.expected {
+				t.Errorf("expandMirrorArg(%q) = %+v, expected %+v", tt.arg, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWithMirror(t *testing.T) {
 	tests := []struct {
 		name        string
 		originalURL string
-		newHost     string
+		mirror      string
 		expected    string
 		shouldError bool
 	}{
 		{
 			name:        "Replace HTTP host",
 			originalURL: "http://example.com/path/to/file",
-			newHost:     "https://mirror.com",
+			mirror:      "https://mirror.com",
 			expected:    "https://mirror.com/path/to/file",
-			shouldError: false,
 		},
 		{
 			name:        "Replace with query params",
 			originalURL: "http://example.com/path?query=value",
-			newHost:     "https://mirror.com",
+			mirror:      "https://mirror.com",
 			expected:    "https://mirror.com/path?query=value",
-			shouldError: false,
 		},
 		{
 			name:        "Replace HTTPS with HTTP",
 			originalURL: "https://secure.com/file",
-			newHost:     "http://mirror.com",
+			mirror:      "http://mirror.com",
 			expected:    "http://mirror.com/file",
-			shouldError: false,
-		},
-		{
-			name:        "Invalid original URL",
-			originalURL: "://invalid",
-			newHost:     "https://mirror.com",
-			expected:    "",
-			shouldError: true,
 		},
 		{
 			name:        "Invalid mirror URL",
 			originalURL: "https://example.com/path",
-			newHost:     "://invalid",
-			expected:    "",
+			mirror:      "://invalid",
 			shouldError: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result, err := proxy.replaceHost(tt.originalURL, tt.newHost)
+			req := httptest.NewRequest("GET", tt.originalURL, nil)
+
+			result, err := withMirror(req, tt.mirror)
 
 			if tt.shouldError {
 				if err == nil {
 					t.Error("Expected error but got none")
 				}
-			} else {
-				if err != nil {
-					t.Errorf("Unexpected error: %v", err)
-				}
-				if result != tt.expected {
-					t.Errorf("Expected %s, got %s", tt.expected, result)
-				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result.URL.String() != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, result.URL.String())
 			}
 		})
 	}
@@ -102,7 +185,7 @@ func TestServeHTTP_Success(t *testing.T) {
 	defer backend.Close()
 
 	// Create proxy without mirrors
-	proxy := NewProxy(nil)
+	proxy := mustNewProxy(t, nil)
 
 	// Create a test request through the proxy
 	req := httptest.NewRequest("GET", backend.URL+"/test", nil)
@@ -136,7 +219,7 @@ func TestServeHTTP_404_NoMirrors(t *testing.T) {
 	defer backend.Close()
 
 	// Create proxy without mirrors
-	proxy := NewProxy(nil)
+	proxy := mustNewProxy(t, nil)
 
 	req := httptest.NewRequest("GET", backend.URL+"/missing", nil)
 	w := httptest.NewRecorder()
@@ -179,7 +262,7 @@ func TestServeHTTP_404_WithMirrorFallback(t *testing.T) {
 	defer mirror2.Close()
 
 	// Create proxy with mirrors
-	proxy := NewProxy([]string{mirror1.URL, mirror2.URL})
+	proxy := mustNewProxy(t, []string{mirror1.URL, mirror2.URL})
 
 	req := httptest.NewRequest("GET", primary.URL+"/file.txt", nil)
 	w := httptest.NewRecorder()
@@ -211,6 +294,46 @@ func TestServeHTTP_404_WithMirrorFallback(t *testing.T) {
 	}
 }
 
+// TestServeHTTP_404_MirrorTransportErrorFallsThroughToNextMirror guards
+// against a nil resp from a mid-chain mirror's transport error (dial
+// refused, timeout, DNS failure - RoundTrip never returns a response
+// alongside an error) being dereferenced by the next iteration's
+// resp.Body.Close(). The default (sequential) strategy must fall through
+// to the next, working mirror instead of panicking.
+func TestServeHTTP_404_MirrorTransportErrorFallsThroughToNextMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer primary.Close()
+
+	// unreachable: closed immediately, so dialing it refuses the connection
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	unreachable.Close()
+
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("found on working mirror"))
+	}))
+	defer working.Close()
+
+	proxy := mustNewProxy(t, []string{unreachable.URL, working.URL})
+
+	req := httptest.NewRequest("GET", primary.URL+"/file.txt", nil)
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if string(body) != "found on working mirror" {
+		t.Errorf("Expected body 'found on working mirror', got '%s'", string(body))
+	}
+}
+
 func TestServeHTTP_404_AllMirrorsFail(t *testing.T) {
 	// All servers return 404
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -227,7 +350,7 @@ func TestServeHTTP_404_AllMirrorsFail(t *testing.T) {
 	mirror2 := httptest.NewServer(handler)
 	defer mirror2.Close()
 
-	proxy := NewProxy([]string{mirror1.URL, mirror2.URL})
+	proxy := mustNewProxy(t, []string{mirror1.URL, mirror2.URL})
 
 	req := httptest.NewRequest("GET", primary.URL+"/missing", nil)
 	w := httptest.NewRecorder()
@@ -255,7 +378,7 @@ func TestServeHTTP_PreservesHeaders(t *testing.T) {
 	}))
 	defer backend.Close()
 
-	proxy := NewProxy(nil)
+	proxy := mustNewProxy(t, nil)
 
 	req := httptest.NewRequest("GET", backend.URL, nil)
 	req.Header.Set("User-Agent", "test-agent")
@@ -269,6 +392,361 @@ func TestServeHTTP_PreservesHeaders(t *testing.T) {
 	}
 }
 
+func TestServeHTTP_StripsHopByHopHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("Proxy-Authorization should have been stripped")
+		}
+		if r.Header.Get("X-Session-Id") != "" {
+			t.Error("header listed in Connection should have been stripped")
+		}
+		w.Header().Set("Connection", "X-Upstream-Only")
+		w.Header().Set("X-Upstream-Only", "should-not-reach-client")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	proxy := mustNewProxy(t, nil)
+
+	req := httptest.NewRequest("GET", backend.URL, nil)
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	req.Header.Set("Connection", "X-Session-Id")
+	req.Header.Set("X-Session-Id", "abc123")
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.Header.Get("X-Upstream-Only") != "" {
+		t.Error("hop-by-hop response header listed in Connection should have been stripped")
+	}
+}
+
+func TestServeHTTP_ForwardsRequestBody(t *testing.T) {
+	var receivedBody string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receivedBody = string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	proxy := mustNewProxy(t, nil)
+
+	req := httptest.NewRequest("POST", backend.URL+"/upload", strings.NewReader("payload-bytes"))
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	if receivedBody != "payload-bytes" {
+		t.Errorf("Expected upstream to receive 'payload-bytes', got '%s'", receivedBody)
+	}
+}
+
+func TestServeHTTP_AppendsXForwardedFor(t *testing.T) {
+	var receivedXFF string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedXFF = r.Header.Get("X-Forwarded-For")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	proxy := mustNewProxy(t, nil)
+
+	req := httptest.NewRequest("GET", backend.URL, nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	req.RemoteAddr = "192.0.2.1:54321"
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	expected := "203.0.113.1, 192.0.2.1"
+	if receivedXFF != expected {
+		t.Errorf("Expected X-Forwarded-For '%s', got '%s'", expected, receivedXFF)
+	}
+}
+
+func TestNewProxy_InvalidStrategy(t *testing.T) {
+	_, err := NewProxy(nil, "bogus", 0, CacheConfig{}, HealthCheckConfig{})
+	if err == nil {
+		t.Error("Expected error for unknown mirror strategy, got nil")
+	}
+}
+
+func TestServeHTTP_Parallel_FirstWinnerCancelsOthers(t *testing.T) {
+	var mu sync.Mutex
+	served := 0
+	cancelled := 0
+
+	slowWinner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		served++
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("winner"))
+	}))
+	defer slowWinner.Close()
+
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		mu.Lock()
+		cancelled++
+		mu.Unlock()
+	}))
+	defer stalled.Close()
+
+	proxy, err := NewProxy([]string{stalled.URL}, StrategyParallel, 0, CacheConfig{}, HealthCheckConfig{})
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", slowWinner.URL+"/file.tcz", nil)
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if string(body) != "winner" {
+		t.Errorf("Expected body 'winner', got '%s'", string(body))
+	}
+
+	// Give the cancelled mirror a moment to observe ctx.Done().
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		c := cancelled
+		mu.Unlock()
+		if c == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if served != 1 {
+		t.Errorf("Expected exactly one upstream to serve a response, got %d", served)
+	}
+	if cancelled != 1 {
+		t.Errorf("Expected the losing mirror request to be cancelled, got %d", cancelled)
+	}
+}
+
+// TestServeHTTP_Parallel_WinnerBodyNotTruncatedByLoserCancellation guards
+// against racing candidates sharing a single cancelable context: cancelling
+// the losers must not also cancel the winner's still-streaming response
+// body. A winner body small enough to be read in one buffered copy
+// wouldn't catch this, so this streams several chunks with a flush and a
+// delay between each.
+func TestServeHTTP_Parallel_WinnerBodyNotTruncatedByLoserCancellation(t *testing.T) {
+	const chunkSize = 65536
+	const chunkCount = 10
+
+	winner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		flusher := w.(http.Flusher)
+		chunk := bytes.Repeat([]byte("a"), chunkSize)
+		for i := 0; i < chunkCount; i++ {
+			w.Write(chunk)
+			flusher.Flush()
+			time.Sleep(5 * time.Millisecond)
+		}
+	}))
+	defer winner.Close()
+
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer stalled.Close()
+
+	proxy, err := NewProxy([]string{stalled.URL}, StrategyParallel, 0, CacheConfig{}, HealthCheckConfig{})
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", winner.URL+"/file.tcz", nil)
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading winner body failed (likely truncated by a shared race context): %v", err)
+	}
+
+	if want := chunkSize * chunkCount; len(body) != want {
+		t.Errorf("Expected full streamed body of %d bytes, got %d", want, len(body))
+	}
+}
+
+func TestServeHTTP_Hedged_FansOutAfterDelay(t *testing.T) {
+	var callOrder []string
+	var mu sync.Mutex
+	record := func(name string) {
+		mu.Lock()
+		callOrder = append(callOrder, name)
+		mu.Unlock()
+	}
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record("origin")
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer origin.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record("mirror")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("from mirror"))
+	}))
+	defer mirror.Close()
+
+	proxy, err := NewProxy([]string{mirror.URL}, StrategyHedged, 10*time.Millisecond, CacheConfig{}, HealthCheckConfig{})
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", origin.URL+"/file.tcz", nil)
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if string(body) != "from mirror" {
+		t.Errorf("Expected body 'from mirror', got '%s'", string(body))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(callOrder) != 2 || callOrder[0] != "origin" || callOrder[1] != "mirror" {
+		t.Errorf("Expected origin to be tried before the mirror fanned out, got %v", callOrder)
+	}
+}
+
+func TestServeHTTP_InsecureMirrorSkipsCertVerification(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer primary.Close()
+
+	// A self-signed TLS server would fail normal verification; the
+	// "+insecure" mirror must still be able to reach it.
+	mirror := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("insecure mirror content"))
+	}))
+	defer mirror.Close()
+
+	mirrorArg := "https+insecure://" + strings.TrimPrefix(mirror.URL, "https://")
+	proxy, err := NewProxy([]string{mirrorArg}, StrategySequential, 0, CacheConfig{}, HealthCheckConfig{})
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", primary.URL+"/file.tcz", nil)
+	w := httptest.NewRecorder()
+
+	proxy.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if string(body) != "insecure mirror content" {
+		t.Errorf("Expected body 'insecure mirror content', got '%s'", string(body))
+	}
+}
+
+func TestServeHTTP_Connect_TLSTunnel(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure response"))
+	}))
+	defer backend.Close()
+
+	proxy := mustNewProxy(t, nil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, err := url.Parse(proxyServer.URL)
+	if err != nil {
+		t.Fatalf("failed to parse proxy URL: %v", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("request through CONNECT tunnel failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "secure response" {
+		t.Errorf("Expected 'secure response', got '%s'", string(body))
+	}
+}
+
+func TestServeHTTP_WebSocketEcho(t *testing.T) {
+	echoServer := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer echoServer.Close()
+
+	proxy := mustNewProxy(t, nil)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyServer.URL, "http://"))
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+
+	wsURL := "ws://" + strings.TrimPrefix(echoServer.URL, "http://")
+	config, err := websocket.NewConfig(wsURL, "http://localhost/")
+	if err != nil {
+		t.Fatalf("failed to build websocket config: %v", err)
+	}
+
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		t.Fatalf("websocket handshake through proxy failed: %v", err)
+	}
+	defer ws.Close()
+
+	if _, err := ws.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to write to websocket: %v", err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(ws, buf); err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("Expected echo 'hello', got '%s'", string(buf))
+	}
+}
+
 func TestServeHTTP_PathPreservation(t *testing.T) {
 	// Verify that paths are preserved when using mirrors
 	var receivedPath string
@@ -284,7 +762,7 @@ func TestServeHTTP_PathPreservation(t *testing.T) {
 	}))
 	defer mirror.Close()
 
-	proxy := NewProxy([]string{mirror.URL})
+	proxy := mustNewProxy(t, []string{mirror.URL})
 
 	req := httptest.NewRequest("GET", primary.URL+"/path/to/file?key=value", nil)
 	w := httptest.NewRecorder()
@@ -296,3 +774,290 @@ func TestServeHTTP_PathPreservation(t *testing.T) {
 		t.Errorf("Expected path to contain '%s', got '%s'", expectedPath, receivedPath)
 	}
 }
+
+func TestServeHTTP_Cache_MissThenHit(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("tcz-bytes"))
+	}))
+	defer backend.Close()
+
+	proxy := mustNewCachingProxy(t, nil, CacheConfig{})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", backend.URL+"/tc/pkg.tcz", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+
+		resp := w.Result()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, resp.StatusCode)
+		}
+		if string(body) != "tcz-bytes" {
+			t.Fatalf("request %d: expected 'tcz-bytes', got %q", i, body)
+		}
+	}
+
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("expected backend to be hit exactly once (second request served from cache), got %d", got)
+	}
+}
+
+func TestServeHTTP_Cache_Negative404(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer backend.Close()
+
+	proxy := mustNewCachingProxy(t, nil, CacheConfig{})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", backend.URL+"/tc/missing.tcz", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+
+		if got := w.Result().StatusCode; got != http.StatusNotFound {
+			t.Fatalf("request %d: expected 404, got %d", i, got)
+		}
+	}
+
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Errorf("expected the 404 to be negatively cached after the first request, backend hit %d times", got)
+	}
+}
+
+func TestServeHTTP_Cache_TTLExpiry(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("tcz-bytes"))
+	}))
+	defer backend.Close()
+
+	proxy := mustNewCachingProxy(t, nil, CacheConfig{TTL: duration(10 * time.Millisecond)})
+
+	req := httptest.NewRequest("GET", backend.URL+"/tc/pkg.tcz", nil)
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	time.Sleep(20 * time.Millisecond)
+
+	req2 := httptest.NewRequest("GET", backend.URL+"/tc/pkg.tcz", nil)
+	proxy.ServeHTTP(httptest.NewRecorder(), req2)
+
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("expected backend to be hit again after TTL expiry, got %d hits", got)
+	}
+}
+
+// TestServeHTTP_Cache_UnknownLengthNotCached guards against an unbounded
+// chunked response blowing past max_bytes undetected: since
+// resp.ContentLength is -1 for a response with no Content-Length header,
+// the naive "ContentLength > maxBytes" check never trips, so the response
+// must still be served but skip the cache write.
+func TestServeHTTP_Cache_UnknownLengthNotCached(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.(http.Flusher).Flush() // force chunked encoding, ContentLength == -1
+		w.Write([]byte("tcz-bytes"))
+	}))
+	defer backend.Close()
+
+	cacheDir := t.TempDir()
+	proxy := mustNewCachingProxy(t, nil, CacheConfig{Dir: cacheDir, MaxBytes: 1024})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", backend.URL+"/tc/pkg.tcz", nil)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+
+		resp := w.Result()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, resp.StatusCode)
+		}
+		if string(body) != "tcz-bytes" {
+			t.Fatalf("request %d: expected 'tcz-bytes', got %q", i, body)
+		}
+	}
+
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("expected backend to be hit on every request (unknown-length response should never be cached), got %d", got)
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatalf("reading cache dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected cache_dir to stay empty for an uncached unknown-length response, found %d entries", len(entries))
+	}
+}
+
+func TestServeHTTP_Cache_ChecksumMismatchFailsOverToMirror(t *testing.T) {
+	goodContent := []byte("the-real-package-bytes")
+	sum := md5.Sum(goodContent)
+	goodMD5 := hex.EncodeToString(sum[:])
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, ".md5.txt"):
+			fmt.Fprintf(w, "%s  pkg.tcz\n", goodMD5)
+		case strings.HasSuffix(r.URL.Path, ".tcz"):
+			w.Write([]byte("corrupted-bytes"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer primary.Close()
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".tcz") {
+			w.Write(goodContent)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer mirror.Close()
+
+	proxy := mustNewCachingProxy(t, []string{mirror.URL}, CacheConfig{})
+
+	// Prime the cache with the (correct) MD5 sidecar first, as a real
+	// client's package manager would before fetching the .tcz itself.
+	md5Req := httptest.NewRequest("GET", primary.URL+"/tc/pkg.tcz.md5.txt", nil)
+	md5W := httptest.NewRecorder()
+	proxy.ServeHTTP(md5W, md5Req)
+	if got := md5W.Result().StatusCode; got != http.StatusOK {
+		t.Fatalf("expected md5 sidecar fetch to succeed, got %d", got)
+	}
+
+	tczReq := httptest.NewRequest("GET", primary.URL+"/tc/pkg.tcz", nil)
+	tczW := httptest.NewRecorder()
+	proxy.ServeHTTP(tczW, tczReq)
+
+	resp := tczW.Result()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the mirror's valid copy to win after the primary's failed checksum, got %d", resp.StatusCode)
+	}
+	if string(body) != string(goodContent) {
+		t.Errorf("expected validated mirror content %q, got %q", goodContent, body)
+	}
+
+	// The cached copy should be the validated mirror content, not the
+	// primary's corrupted bytes.
+	cachedReq := httptest.NewRequest("GET", primary.URL+"/tc/pkg.tcz", nil)
+	cachedW := httptest.NewRecorder()
+	proxy.ServeHTTP(cachedW, cachedReq)
+	cachedBody, _ := io.ReadAll(cachedW.Result().Body)
+	if string(cachedBody) != string(goodContent) {
+		t.Errorf("expected cached content %q, got %q", goodContent, cachedBody)
+	}
+}
+
+// mustNewProxyWithHealth is like mustNewProxy but keeps the health checker
+// reachable so tests can probe and rank synchronously. The background
+// ticker is never started (Interval stays 0 unless cfg overrides it).
+func mustNewProxyWithHealth(t *testing.T, mirrors []string, cfg HealthCheckConfig) *Proxy {
+	t.Helper()
+	proxy, err := NewProxy(mirrors, StrategySequential, 0, CacheConfig{}, cfg)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	return proxy
+}
+
+func TestHealthChecker_DemotesSlowMirror(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fast.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slow.Close()
+
+	proxy := mustNewProxyWithHealth(t, []string{slow.URL, fast.URL}, HealthCheckConfig{
+		Timeout: duration(20 * time.Millisecond),
+	})
+
+	proxy.health.probeAll()
+
+	ranked := proxy.health.ranked()
+	if ranked[0].url != fast.URL {
+		t.Errorf("expected the fast mirror ranked first after the slow one timed out, got order %v", ranked)
+	}
+}
+
+func TestHealthChecker_CircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	down.Close() // closed immediately so every probe fails to connect
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	proxy := mustNewProxyWithHealth(t, []string{down.URL, up.URL}, HealthCheckConfig{
+		Timeout:  duration(50 * time.Millisecond),
+		Cooldown: duration(time.Minute),
+	})
+
+	for i := 0; i < circuitBreakerThreshold; i++ {
+		proxy.health.probeAll()
+	}
+
+	if proxy.health.health[down.URL].healthy() {
+		t.Error("expected the down mirror's circuit to be open after repeated failures")
+	}
+
+	ranked := proxy.health.ranked()
+	if ranked[0].url != up.URL {
+		t.Errorf("expected the healthy mirror ranked first once the other's circuit opened, got order %v", ranked)
+	}
+}
+
+func TestServeHTTP_MirrorStatsEndpoint(t *testing.T) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mirror.Close()
+
+	proxy := mustNewProxyWithHealth(t, []string{mirror.URL}, HealthCheckConfig{})
+	proxy.health.probeAll()
+
+	req := httptest.NewRequest("GET", "http://proxy.local/__proxy/mirrors", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected JSON content type, got %q", ct)
+	}
+
+	var stats []mirrorStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(stats) != 1 || stats[0].URL != mirror.URL {
+		t.Errorf("expected stats for %s, got %+v", mirror.URL, stats)
+	}
+	if stats[0].SuccessCount != 1 {
+		t.Errorf("expected 1 recorded success, got %d", stats[0].SuccessCount)
+	}
+}
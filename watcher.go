@@ -0,0 +1,156 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ConfigWatcher holds the live *Proxy behind an atomic pointer and swaps it
+// for a freshly built one whenever the config file changes on disk or the
+// process receives SIGHUP. It implements http.Handler itself, so it can be
+// used directly as the server's handler instead of a fixed *Proxy.
+type ConfigWatcher struct {
+	path  string
+	build func(*Config) (*Proxy, error)
+
+	proxy      atomic.Pointer[Proxy]
+	generation atomic.Uint64
+	lastReload atomic.Int64 // UnixNano; zero until the first successful load
+
+	fsw  *fsnotify.Watcher
+	sig  chan os.Signal
+	done chan struct{}
+}
+
+// NewConfigWatcher builds the initial *Proxy from initial (as already
+// loaded by the caller, so startup fallback behavior for an unreadable
+// config file stays the caller's decision) and prepares - but does not yet
+// start - the SIGHUP/fsnotify reload loop. Reloads re-read path and rebuild
+// the proxy via build; on failure they log and leave the current proxy in
+// place.
+func NewConfigWatcher(path string, initial *Config, build func(*Config) (*Proxy, error)) (*ConfigWatcher, error) {
+	proxy, err := build(initial)
+	if err != nil {
+		return nil, err
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := fsw.Add(filepath.Dir(path)); err != nil {
+		fsw.Close()
+		return nil, err
+	}
+
+	cw := &ConfigWatcher{
+		path:  path,
+		build: build,
+		fsw:   fsw,
+		sig:   make(chan os.Signal, 1),
+		done:  make(chan struct{}),
+	}
+	cw.proxy.Store(proxy)
+	cw.generation.Store(1)
+	cw.lastReload.Store(time.Now().UnixNano())
+
+	signal.Notify(cw.sig, syscall.SIGHUP)
+
+	return cw, nil
+}
+
+// Start launches the background loop that watches for SIGHUP and config
+// file change events. It returns immediately.
+func (cw *ConfigWatcher) Start() {
+	go cw.run()
+}
+
+// Stop ends the background loop and releases the file watcher.
+func (cw *ConfigWatcher) Stop() {
+	signal.Stop(cw.sig)
+	close(cw.done)
+	cw.fsw.Close()
+}
+
+func (cw *ConfigWatcher) run() {
+	for {
+		select {
+		case <-cw.done:
+			return
+		case _, ok := <-cw.sig:
+			if !ok {
+				return
+			}
+			slog.Info("received SIGHUP, reloading config", "path", cw.path)
+			cw.reload()
+		case event, ok := <-cw.fsw.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(cw.path) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			slog.Info("config file changed, reloading", "path", cw.path)
+			cw.reload()
+		case err, ok := <-cw.fsw.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("config watcher error", "error", err)
+		}
+	}
+}
+
+// reload rebuilds the proxy from path and swaps it in on success. On
+// failure (unreadable file, invalid YAML, bad regex, ...) it logs and keeps
+// the currently loaded proxy running.
+func (cw *ConfigWatcher) reload() {
+	config, err := loadConfig(cw.path)
+	if err != nil {
+		slog.Error("config reload failed, keeping current config", "error", err)
+		return
+	}
+
+	proxy, err := cw.build(config)
+	if err != nil {
+		slog.Error("config reload failed, keeping current config", "error", err)
+		return
+	}
+
+	cw.proxy.Store(proxy)
+	generation := cw.generation.Add(1)
+	cw.lastReload.Store(time.Now().UnixNano())
+	slog.Info("config reloaded", "generation", generation)
+}
+
+// Generation returns how many times the config has been successfully
+// (re)loaded, starting at 1 for the initial load.
+func (cw *ConfigWatcher) Generation() uint64 {
+	return cw.generation.Load()
+}
+
+// LastReload returns when the currently active config was loaded.
+func (cw *ConfigWatcher) LastReload() time.Time {
+	return time.Unix(0, cw.lastReload.Load())
+}
+
+func (cw *ConfigWatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cw.proxy.Load().ServeHTTP(w, r)
+}
+
+// Metrics returns the currently loaded proxy's Metrics, so the admin
+// listener's /metrics handler always reflects the live config generation.
+func (cw *ConfigWatcher) Metrics() *Metrics {
+	return cw.proxy.Load().metrics
+}
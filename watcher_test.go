@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testBuildProxy(c *Config) (*Proxy, error) {
+	return NewProxy(c.DefaultHost, c.Routes, c.FollowRedirects, c.Auth, c.ProxyURL, c.ProxyConnectHeader, time.Duration(c.FlushInterval))
+}
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+}
+
+func waitForGeneration(t *testing.T, cw *ConfigWatcher, want uint64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cw.Generation() >= want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for generation %d, got %d", want, cw.Generation())
+}
+
+func TestConfigWatcher_ReloadsOnFileChange(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	writeConfig(t, configPath, "default_host: https://one.example.com\n")
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	cw, err := NewConfigWatcher(configPath, config, testBuildProxy)
+	if err != nil {
+		t.Fatalf("NewConfigWatcher failed: %v", err)
+	}
+	cw.Start()
+	defer cw.Stop()
+
+	if cw.Generation() != 1 {
+		t.Fatalf("expected initial generation 1, got %d", cw.Generation())
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/test", nil)
+	w := httptest.NewRecorder()
+	cw.ServeHTTP(w, req)
+	if got := w.Result().Header.Get("X-Test-Backend"); got != "" {
+		t.Fatalf("unexpected header before backend exists: %q", got)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test-Backend", "one")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	writeConfig(t, configPath, "default_host: "+backend.URL+"\n")
+	waitForGeneration(t, cw, 2)
+
+	req = httptest.NewRequest("GET", "http://localhost/test", nil)
+	w = httptest.NewRecorder()
+	cw.ServeHTTP(w, req)
+	if got := w.Result().Header.Get("X-Test-Backend"); got != "one" {
+		t.Errorf("expected reloaded proxy to reach new backend, got header %q", got)
+	}
+
+	lastReload := cw.LastReload()
+	if time.Since(lastReload) > 2*time.Second || time.Since(lastReload) < 0 {
+		t.Errorf("LastReload %v looks wrong", lastReload)
+	}
+}
+
+func TestConfigWatcher_KeepsCurrentOnInvalidReload(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	writeConfig(t, configPath, "default_host: https://one.example.com\n")
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatalf("loadConfig failed: %v", err)
+	}
+
+	cw, err := NewConfigWatcher(configPath, config, testBuildProxy)
+	if err != nil {
+		t.Fatalf("NewConfigWatcher failed: %v", err)
+	}
+	cw.Start()
+	defer cw.Stop()
+
+	writeConfig(t, configPath, "routes:\n  - from: \"[\"\n    to: \"https://example.com\"\n")
+
+	time.Sleep(200 * time.Millisecond)
+	if cw.Generation() != 1 {
+		t.Errorf("expected generation to stay at 1 after invalid reload, got %d", cw.Generation())
+	}
+}